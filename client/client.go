@@ -9,30 +9,91 @@ import (
 	"io/ioutil"
 	"log"
 	"mqtt2clickhouse/message"
+	"mqtt2clickhouse/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // MqttClient структура для подключения к брокеру mqtt.
+// topics содержит текущие подписки: ключ из consul и топик.
+// pending содержит топики, подписаться на которые не удалось, подписка на них повторяется через retryDelay.
+// filters содержит топики подписок для определения подписки полученного сообщения.
 type MqttClient struct {
-	opts   *mqtt.ClientOptions
-	client mqtt.Client
-	topics []string
+	opts       *mqtt.ClientOptions
+	client     mqtt.Client
+	topics     map[string]string
+	pending    map[string]bool
+	retryDelay time.Duration
+	retryTimer *time.Timer
+	mu         sync.Mutex
+	filters    []string
+	filtersMu  sync.RWMutex
+	delivery   deliveryTracker
 }
 
+// subscribeRetryDelay задержка повторной подписки на топики, подписаться на которые не удалось.
+const subscribeRetryDelay = 10 * time.Second
+
+// deliveryTracker отслеживает передачу полученных сообщений в очередь.
+type deliveryTracker struct {
+	mu       sync.Mutex
+	inFlight int
+	last     time.Time
+}
+
+// begin отмечает начало обработки сообщения.
+func (d *deliveryTracker) begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight++
+	d.last = time.Now()
+}
+
+// end отмечает окончание обработки сообщения.
+func (d *deliveryTracker) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight--
+	d.last = time.Now()
+}
+
+// quietFor проверяет, что сообщения не обрабатываются и не поступали в течение quiet.
+func (d *deliveryTracker) quietFor(quiet time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inFlight == 0 && time.Since(d.last) >= quiet
+}
+
+// unknownFilter подписка в метриках для сообщений, которые не соответствуют ни одной текущей подписке.
+const unknownFilter = "unknown"
+
 // messagePubHandler обработчик событий при получении сообщений из mqtt.
-var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	message.DataChannel <- &message.Message{Topic: msg.Topic(), Value: msg.Payload()}
+// filter - подписка, по которой получено сообщение.
+var messagePubHandler = func(filter string, msg mqtt.Message) {
+	metrics.MessagesReceived.WithLabelValues(filter).Inc()
+	message.DataChannel <- &message.Message{Topic: msg.Topic(), Value: msg.Payload(), Received: time.Now()}
 }
 
 // connectHandler обработчик событий при подключении к mqtt.
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	metrics.MQTTConnected.Set(1)
 	logger("Соединение с mqtt установлено")
 }
 
 // connectLostHandler обработчик событий при потере соединения с mqtt.
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+	metrics.MQTTConnected.Set(0)
 	logger(fmt.Sprintf("Соединение с mqtt потеряно: %v", err))
 }
 
+// reconnectHandler обработчик событий при переподключении к mqtt.
+var reconnectHandler mqtt.ReconnectHandler = func(client mqtt.Client, opts *mqtt.ClientOptions) {
+	metrics.MQTTReconnects.Inc()
+	logger("Переподключение к mqtt")
+}
+
 // readPemFile читает данные pem сертификата из файла
 var readPemFile = func(pemPath string) ([]byte, error) {
 	pemData, err := ioutil.ReadFile(pemPath)
@@ -106,9 +167,17 @@ func (m *MqttClient) SignIn(username, password string) {
 
 // SetHandler добавляет обработчки событий в настройки подключения к mqtt.
 func (m *MqttClient) SetHandler() {
-	m.opts.SetDefaultPublishHandler(messagePubHandler)
-	m.opts.OnConnect = connectHandler
+	m.opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		m.delivery.begin()
+		defer m.delivery.end()
+		messagePubHandler(m.topicFilter(msg.Topic()), msg)
+	})
+	m.opts.OnConnect = func(client mqtt.Client) {
+		connectHandler(client)
+		m.resubscribe()
+	}
 	m.opts.OnConnectionLost = connectLostHandler
+	m.opts.OnReconnecting = reconnectHandler
 }
 
 // Connecting подключается к mqtt используя полученные ранее настройки.
@@ -122,39 +191,268 @@ func (m *MqttClient) Connecting() *mqtt.Client {
 	return &m.client
 }
 
+// Disconnect отключается от mqtt, ожидая завершения обработки сообщений не более quiesce миллисекунд.
+func (m *MqttClient) Disconnect(quiesce uint) {
+	if !isConnected(m) {
+		return
+	}
+
+	m.client.Disconnect(quiesce)
+	metrics.MQTTConnected.Set(0)
+	logger("Соединение с mqtt закрыто")
+}
+
+// WaitQuiet ожидает, пока полученные сообщения не перестанут поступать в очередь в течение quiet,
+// но не дольше timeout. После отписки брокер еще может доставить сообщения QoS 1, отправленные до нее.
+// Возвращает false, если сообщения продолжали поступать до истечения timeout.
+func (m *MqttClient) WaitQuiet(quiet, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !m.delivery.quietFor(quiet) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
 // SubscribeAll подписывается на указанные топики.
 func (m *MqttClient) SubscribeAll(topics map[string]string) {
 	if len(topics) == 0 || !isConnected(m) {
 		return
 	}
 
-	for _, topic := range topics {
-		token := m.client.Subscribe(topic, 1, nil)
-		token.Wait()
-		m.topics = append(m.topics, topic)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.updateFilters()
+
+	for key, topic := range topics {
+		m.topics[key] = topic
+		if err := subscribe(m, topic); err != nil {
+			logger(fmt.Sprintf("Не удалось подписаться на топик %s: %s", topic, err))
+			m.pending[topic] = true
+			continue
+		}
+		delete(m.pending, topic)
 		logger(fmt.Sprintf("Подписка на топик %s", topic))
 	}
+	m.scheduleRetry()
 }
 
 // UnsubscribeAll отписывается от всех топиков.
 func (m *MqttClient) UnsubscribeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.updateFilters()
+
+	m.pending = make(map[string]bool)
+	m.stopRetry()
+
 	if len(m.topics) == 0 || !isConnected(m) {
 		return
 	}
 
 	logger("Отписка от всех топиков")
-	m.client.Unsubscribe(m.topics...)
-	m.topics = nil
+	if err := unsubscribe(m, uniqueTopics(m.topics)...); err != nil {
+		logger(fmt.Sprintf("Ошибка при отписке от топиков: %s", err))
+	}
+	m.topics = make(map[string]string)
 }
 
-// Publish отправляет сообщение в указанный топик.
-func (m *MqttClient) Publish(topic string, message string) {
+// UpdateSubscriptions приводит подписки к новому списку топиков.
+// Ключ списка определяет подписку: подписка выполняется только на новые и измененные топики,
+// отписка - только от топиков, которые больше не используются ни одной подпиской.
+// Без подключения к брокеру список только сохраняется, подписка на него выполнится при подключении.
+// Подписка на топики, подписаться на которые не удалось, повторяется через retryDelay и при переподключении.
+func (m *MqttClient) UpdateSubscriptions(topics map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.updateFilters()
+
 	if !isConnected(m) {
+		logger("Нет подключения к mqtt, подписки будут обновлены при подключении")
+		m.pending = make(map[string]bool)
+		m.topics = make(map[string]string)
+		for key, topic := range topics {
+			m.topics[key] = topic
+		}
+		return
+	}
+
+	oldTopics := make(map[string]bool)
+	for key, topic := range m.topics {
+		oldTopics[topic] = true
+		if newTopic, ok := topics[key]; !ok {
+			logger(fmt.Sprintf("Подписка %s удалена: %s", key, topic))
+		} else if newTopic != topic {
+			logger(fmt.Sprintf("Подписка %s изменена: %s -> %s", key, topic, newTopic))
+		}
+	}
+
+	newTopics := make(map[string]bool)
+	for key, topic := range topics {
+		newTopics[topic] = true
+		if _, ok := m.topics[key]; !ok {
+			logger(fmt.Sprintf("Подписка %s добавлена: %s", key, topic))
+		}
+	}
+
+	var removed []string
+	for topic := range oldTopics {
+		if !newTopics[topic] {
+			removed = append(removed, topic)
+		}
+	}
+	sort.Strings(removed)
+
+	if len(removed) > 0 {
+		if err := unsubscribe(m, removed...); err != nil {
+			logger(fmt.Sprintf("Ошибка при отписке от топиков %v: %s", removed, err))
+		}
+	}
+
+	// Подписки, которые не удалось выполнить, сохраняются и повторяются по таймеру.
+	pending := make(map[string]bool)
+	for topic := range newTopics {
+		if oldTopics[topic] && !m.pending[topic] {
+			continue
+		}
+		if err := subscribe(m, topic); err != nil {
+			logger(fmt.Sprintf("Не удалось подписаться на топик %s: %s", topic, err))
+			pending[topic] = true
+		}
+	}
+
+	m.pending = pending
+	m.topics = make(map[string]string)
+	for key, topic := range topics {
+		m.topics[key] = topic
+	}
+	m.scheduleRetry()
+}
+
+// resubscribe повторно подписывается на все текущие топики после переподключения к брокеру.
+func (m *MqttClient) resubscribe() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pending = make(map[string]bool)
+	for _, topic := range uniqueTopics(m.topics) {
+		if err := subscribe(m, topic); err != nil {
+			logger(fmt.Sprintf("Не удалось восстановить подписку на топик %s: %s", topic, err))
+			m.pending[topic] = true
+		}
+	}
+	m.scheduleRetry()
+}
+
+// retryPending повторяет подписку на топики, подписаться на которые не удалось.
+// Без подключения к брокеру подписка повторится при подключении.
+func (m *MqttClient) retryPending() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.retryTimer = nil
+	if len(m.pending) == 0 || !isConnected(m) {
+		return
+	}
+
+	for topic := range m.pending {
+		if err := subscribe(m, topic); err != nil {
+			logger(fmt.Sprintf("Не удалось подписаться на топик %s: %s", topic, err))
+			continue
+		}
+		delete(m.pending, topic)
+		logger(fmt.Sprintf("Подписка на топик %s", topic))
+	}
+	m.scheduleRetry()
+}
+
+// scheduleRetry запускает таймер повторной подписки, если есть топики, подписаться на которые не удалось.
+// Вызывается под блокировкой.
+func (m *MqttClient) scheduleRetry() {
+	if len(m.pending) == 0 || m.retryTimer != nil {
 		return
 	}
+	m.retryTimer = time.AfterFunc(m.retryDelay, m.retryPending)
+}
+
+// stopRetry останавливает таймер повторной подписки. Вызывается под блокировкой.
+func (m *MqttClient) stopRetry() {
+	if m.retryTimer != nil {
+		m.retryTimer.Stop()
+		m.retryTimer = nil
+	}
+}
+
+// updateFilters обновляет топики подписок по текущему списку. Вызывается под блокировкой.
+func (m *MqttClient) updateFilters() {
+	filters := uniqueTopics(m.topics)
+
+	m.filtersMu.Lock()
+	defer m.filtersMu.Unlock()
+	m.filters = filters
+}
+
+// topicFilter возвращает топик подписки, которой соответствует топик сообщения.
+// Использует отдельную блокировку, чтобы получение сообщений не ожидало подписки на топики.
+func (m *MqttClient) topicFilter(topic string) string {
+	m.filtersMu.RLock()
+	defer m.filtersMu.RUnlock()
+
+	for _, filter := range m.filters {
+		if matchTopic(filter, topic) {
+			return filter
+		}
+	}
+	return unknownFilter
+}
+
+// matchTopic проверяет соответствие топика сообщения топику подписки с символами + и #.
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// uniqueTopics возвращает отсортированный список топиков без повторов.
+func uniqueTopics(topics map[string]string) []string {
+	unique := make(map[string]bool)
+	for _, topic := range topics {
+		unique[topic] = true
+	}
+
+	result := make([]string, 0, len(unique))
+	for topic := range unique {
+		result = append(result, topic)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Publish отправляет сообщение в указанный топик.
+func (m *MqttClient) Publish(topic string, message string) error {
+	if !isConnected(m) {
+		return fmt.Errorf("Нет подключения к mqtt, сообщение в топик %s не отправлено\n", topic)
+	}
 
 	token := m.client.Publish(topic, 0, false, message)
 	token.Wait()
+	return token.Error()
+}
+
+// IsConnected проверяет подключение к брокеру.
+func (m *MqttClient) IsConnected() bool {
+	return isConnected(m)
 }
 
 // isConnected проверка подключения к брокеру.
@@ -162,6 +460,20 @@ var isConnected = func(m *MqttClient) bool {
 	return m.client.IsConnected()
 }
 
+// subscribe подписывается на топик.
+var subscribe = func(m *MqttClient, topic string) error {
+	token := m.client.Subscribe(topic, 1, nil)
+	token.Wait()
+	return token.Error()
+}
+
+// unsubscribe отписывается от топиков.
+var unsubscribe = func(m *MqttClient, topics ...string) error {
+	token := m.client.Unsubscribe(topics...)
+	token.Wait()
+	return token.Error()
+}
+
 // logger ведет лог событий в ходе работы программы
 var logger = func(message string) {
 	log.Println(message)
@@ -170,5 +482,6 @@ var logger = func(message string) {
 // MakeMQTTClient функция возвращает объект для подключения к mqtt.
 func MakeMQTTClient() MqttClient {
 	opts := mqtt.NewClientOptions()
-	return MqttClient{opts: opts, client: mqtt.NewClient(opts), topics: nil}
+	return MqttClient{opts: opts, client: mqtt.NewClient(opts), topics: make(map[string]string),
+		pending: make(map[string]bool), retryDelay: subscribeRetryDelay}
 }
@@ -1,7 +1,12 @@
 package client
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var isConnectedFalse = func(m *MqttClient) bool {
@@ -12,14 +17,26 @@ var isConnectedTrue = func(m *MqttClient) bool {
 	return true
 }
 
-var WithoutLogger = func(message string){}
+var WithoutLogger = func(message string) {}
+
+var subscribeOK = func(m *MqttClient, topic string) error {
+	return nil
+}
+
+var unsubscribeOK = func(m *MqttClient, topics ...string) error {
+	return nil
+}
 
 var savedFuncLog = logger
 var savedFuncIsConnected = isConnected
+var savedFuncSubscribe = subscribe
+var savedFuncUnsubscribe = unsubscribe
 
 func restoreSettings() {
 	logger = savedFuncLog
 	isConnected = savedFuncIsConnected
+	subscribe = savedFuncSubscribe
+	unsubscribe = savedFuncUnsubscribe
 }
 
 func TestMakeMQTTClient(t *testing.T) {
@@ -38,9 +55,9 @@ func TestMakeMQTTClient(t *testing.T) {
 
 func TestSetTLSSettings(t *testing.T) {
 	type testVariant struct {
-		caPath string
+		caPath   string
 		certPath string
-		keyPath string
+		keyPath  string
 	}
 
 	testVariants := []*testVariant{
@@ -63,11 +80,11 @@ func TestSetTLSSettings(t *testing.T) {
 
 func TestSetBrokerUrl(t *testing.T) {
 	type testVariant struct {
-		inHost  string
-		inPort int
-		outHost string
+		inHost    string
+		inPort    int
+		outHost   string
 		outScheme string
-		err bool
+		err       bool
 	}
 
 	testVariants := []*testVariant{
@@ -116,7 +133,7 @@ func TestGetCertPool(t *testing.T) {
 	}
 
 	savedFunc := readPemFile
-	defer func() {readPemFile = savedFunc}()
+	defer func() { readPemFile = savedFunc }()
 
 	readPemFile = func(pemPath string) ([]byte, error) {
 
@@ -169,7 +186,7 @@ F10YlqcOmeX1uFmKbdi/XorGlkCoMF3TDx8rmp9DBiB/
 		return []byte(RandomPemFile), nil
 	}
 
-	correctPath:= "correctPath"
+	correctPath := "correctPath"
 	result, _ := getCertPool(correctPath)
 	crt := result.Subjects()
 
@@ -181,6 +198,7 @@ F10YlqcOmeX1uFmKbdi/XorGlkCoMF3TDx8rmp9DBiB/
 func TestSubscribeAll(t *testing.T) {
 	logger = WithoutLogger
 	isConnected = isConnectedFalse
+	subscribe = subscribeOK
 	defer restoreSettings()
 
 	testTopics := map[string]string{"name": "test"}
@@ -209,12 +227,13 @@ func TestSubscribeAll(t *testing.T) {
 func TestUnsubscribeAll(t *testing.T) {
 	logger = WithoutLogger
 	isConnected = isConnectedFalse
+	unsubscribe = unsubscribeOK
 	defer restoreSettings()
 
 	ErrMessage := "Ожидаемое количество подписок в брокере: %v факт: %v"
 
 	m := MakeMQTTClient()
-	m.topics = append(m.topics, "test")
+	m.topics["test"] = "test"
 	m.UnsubscribeAll()
 
 	if len(m.topics) != 1 {
@@ -228,3 +247,205 @@ func TestUnsubscribeAll(t *testing.T) {
 		t.Errorf(ErrMessage, 0, len(m.topics))
 	}
 }
+
+func TestDisconnect(t *testing.T) {
+	var logged []string
+	logger = func(message string) { logged = append(logged, message) }
+	isConnected = isConnectedFalse
+	defer restoreSettings()
+
+	m := MakeMQTTClient()
+	m.Disconnect(0)
+
+	if len(logged) != 0 {
+		t.Errorf("Без подключения к брокеру отключение не должно выполняться")
+	}
+
+	isConnected = isConnectedTrue
+	m.Disconnect(0)
+
+	if len(logged) != 1 {
+		t.Errorf("При подключении к брокеру должно выполняться отключение")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	isConnected = isConnectedFalse
+	defer restoreSettings()
+
+	m := MakeMQTTClient()
+	err := m.Publish("test", "test")
+
+	if err == nil {
+		t.Errorf("Без подключения к брокеру должна возникать ошибка отправки")
+	}
+}
+
+func TestUpdateSubscriptions(t *testing.T) {
+	logger = WithoutLogger
+	isConnected = isConnectedTrue
+	defer restoreSettings()
+
+	var subscribed, unsubscribed []string
+	subscribe = func(m *MqttClient, topic string) error {
+		subscribed = append(subscribed, topic)
+		if topic == "broken" {
+			return fmt.Errorf("ошибка подписки")
+		}
+		return nil
+	}
+	unsubscribe = func(m *MqttClient, topics ...string) error {
+		unsubscribed = append(unsubscribed, topics...)
+		return nil
+	}
+
+	m := MakeMQTTClient()
+	defer m.UnsubscribeAll()
+	m.topics = map[string]string{
+		"temp":   "/+/+/out/sensors/temp_out",
+		"hum":    "/+/+/out/sensors/hum_out",
+		"common": "/+/+/out/sensors/common",
+		"alias":  "/+/+/out/sensors/common",
+	}
+
+	m.UpdateSubscriptions(map[string]string{
+		"temp":   "/+/+/out/sensors/temp_out",
+		"hum":    "/+/+/out/sensors/humidity",
+		"common": "/+/+/out/sensors/common",
+		"co2":    "/+/+/out/sensors/co2",
+		"bad":    "broken",
+	})
+
+	sort.Strings(subscribed)
+	expectedSubscribed := []string{"/+/+/out/sensors/co2", "/+/+/out/sensors/humidity", "broken"}
+	if !reflect.DeepEqual(subscribed, expectedSubscribed) {
+		t.Errorf("Подписка должна выполняться только на новые топики. Ожидание: %v, факт: %v",
+			expectedSubscribed, subscribed)
+	}
+
+	expectedUnsubscribed := []string{"/+/+/out/sensors/hum_out"}
+	if !reflect.DeepEqual(unsubscribed, expectedUnsubscribed) {
+		t.Errorf("Отписка должна выполняться только от неиспользуемых топиков. Ожидание: %v, факт: %v",
+			expectedUnsubscribed, unsubscribed)
+	}
+
+	expectedTopics := map[string]string{
+		"temp":   "/+/+/out/sensors/temp_out",
+		"hum":    "/+/+/out/sensors/humidity",
+		"common": "/+/+/out/sensors/common",
+		"co2":    "/+/+/out/sensors/co2",
+		"bad":    "broken",
+	}
+	if !reflect.DeepEqual(m.topics, expectedTopics) {
+		t.Errorf("Неверный список подписок. Ожидание: %v, факт: %v", expectedTopics, m.topics)
+	}
+	if !reflect.DeepEqual(m.pending, map[string]bool{"broken": true}) {
+		t.Errorf("Топик, подписаться на который не удалось, должен ожидать повторной подписки: %v", m.pending)
+	}
+
+	subscribed = nil
+	m.UpdateSubscriptions(expectedTopics)
+	if !reflect.DeepEqual(subscribed, []string{"broken"}) {
+		t.Errorf("При обновлении подписка должна повторяться только для ожидающих топиков: %v", subscribed)
+	}
+
+	subscribed, unsubscribed = nil, nil
+	isConnected = isConnectedFalse
+	m.UpdateSubscriptions(map[string]string{"temp": "/+/+/out/sensors/temp_out"})
+
+	if len(subscribed) != 0 || len(unsubscribed) != 0 {
+		t.Errorf("Без подключения к брокеру не должно быть запросов подписки и отписки")
+	}
+	if len(m.topics) != 1 {
+		t.Errorf("Без подключения к брокеру новый список подписок должен сохраняться: %v", m.topics)
+	}
+}
+
+func TestWaitQuiet(t *testing.T) {
+	m := MakeMQTTClient()
+	if !m.WaitQuiet(0, 0) {
+		t.Errorf("Без полученных сообщений ожидание не требуется")
+	}
+
+	m.delivery.begin()
+	if m.WaitQuiet(10*time.Millisecond, 50*time.Millisecond) {
+		t.Errorf("Ожидание должно завершаться по таймауту, пока сообщение передается в очередь")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.delivery.end()
+	}()
+	start := time.Now()
+	if !m.WaitQuiet(20*time.Millisecond, time.Second) || time.Since(start) < 70*time.Millisecond {
+		t.Errorf("Ожидание должно завершаться через quiet после передачи последнего сообщения")
+	}
+}
+
+func TestTopicFilter(t *testing.T) {
+	logger = WithoutLogger
+	isConnected = isConnectedTrue
+	subscribe = subscribeOK
+	defer restoreSettings()
+
+	m := MakeMQTTClient()
+	m.SubscribeAll(map[string]string{
+		"weather":   "/+/+/weather/#",
+		"telemetry": "+/+/+/telemetry/+",
+	})
+
+	type testVariant struct {
+		topic  string
+		filter string
+	}
+
+	testVariants := []*testVariant{
+		{topic: "/client1/device1/weather/temp", filter: "/+/+/weather/#"},
+		{topic: "/client2/device2/weather", filter: "/+/+/weather/#"},
+		{topic: "tenant/site/device/telemetry/power", filter: "+/+/+/telemetry/+"},
+		{topic: "tenant/site/device/telemetry/power/extra", filter: unknownFilter},
+		{topic: "other", filter: unknownFilter},
+	}
+
+	for i, v := range testVariants {
+		filter := m.topicFilter(v.topic)
+		if filter != v.filter {
+			t.Errorf("№%v. Топик %s. Ожидание: %s, факт: %s", i, v.topic, v.filter, filter)
+		}
+	}
+}
+
+func TestRetryPending(t *testing.T) {
+	logger = WithoutLogger
+	isConnected = isConnectedTrue
+	defer restoreSettings()
+
+	var count int32
+	attempts := make(chan string, 10)
+	subscribe = func(m *MqttClient, topic string) error {
+		attempts <- topic
+		if atomic.AddInt32(&count, 1) == 1 {
+			return fmt.Errorf("ошибка подписки")
+		}
+		return nil
+	}
+
+	m := MakeMQTTClient()
+	m.retryDelay = 10 * time.Millisecond
+	m.UpdateSubscriptions(map[string]string{"temp": "/+/+/out/sensors/temp_out"})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(time.Second):
+			t.Fatalf("Подписка на топик должна повторяться по таймеру")
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) != 0 || m.retryTimer != nil {
+		t.Errorf("После успешной подписки не должно остаться ожидающих топиков: %v", m.pending)
+	}
+}
@@ -2,14 +2,20 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	consulApi "github.com/hashicorp/consul/api"
 	"io/ioutil"
+	"mqtt2clickhouse/db"
+	"mqtt2clickhouse/message"
+	"os"
+	"time"
 )
 
 const (
 	defaultTLSConfigFile = "config/configTLS.json"
+	defaultAppConfigFile = "config/configApp.json"
 	topicsPathInKV       = "mqttClient/topics"
 )
 
@@ -20,10 +26,21 @@ type configTLS struct {
 	KeyPath  string `json:"keyPath"`
 }
 
-// StoreKV содержит клиент подключения к consul и последний полученный индекс.
+// configApp содержит настройки обработки сообщений и записи в БД.
+// Driver - драйвер подключения к БД: http (по умолчанию) или native.
+type configApp struct {
+	Driver  string            `json:"driver"`
+	Engine  db.EngineSettings `json:"engine"`
+	Schema  db.SchemaSettings `json:"schema"`
+	Message message.Settings  `json:"message"`
+}
+
+// StoreKV содержит клиент подключения к consul, последний полученный индекс
+// и максимальное время ожидания изменений в блокирующем запросе.
 type StoreKV struct {
 	client    *consulApi.Client
 	LastIndex uint64
+	WaitTime  time.Duration
 }
 
 // readSettingsFile возвращает прочитанный файл настроек.
@@ -49,6 +66,26 @@ func ReadSettings() (*configTLS, error) {
 	return cfg, nil
 }
 
+// ReadAppSettings читает файл настроек приложения. Если файла нет, то возвращаются настройки по умолчанию.
+func ReadAppSettings() (*configApp, error) {
+	var cfg = &configApp{Message: message.DefaultSettings()}
+
+	data, err := readSettingsFile(defaultAppConfigFile)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Ошибка при чтении файла: %s\n", err)
+	}
+
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Ошибка при чтении настроек из файла %s. %s\n",
+			defaultAppConfigFile, err)
+	}
+
+	return cfg, nil
+}
+
 // MakeKVClient возвращает объект для подключения к consul.
 func MakeKVClient() StoreKV {
 	return StoreKV{LastIndex: 0}
@@ -70,7 +107,13 @@ func (s *StoreKV) Connect(address string) (*consulApi.Client, error) {
 
 // LoadConfig получает данные из consul и возвращает их в виде map.
 func (s *StoreKV) LoadConfig(fieldName string) (map[string]string, bool, error) {
-	QueryOpt := &consulApi.QueryOptions{WaitIndex: s.LastIndex}
+	return s.LoadConfigContext(context.Background(), fieldName)
+}
+
+// LoadConfigContext получает данные из consul и возвращает их в виде map.
+// Если данные уже получались, то запрос ждет их изменения не дольше WaitTime или до отмены ctx.
+func (s *StoreKV) LoadConfigContext(ctx context.Context, fieldName string) (map[string]string, bool, error) {
+	QueryOpt := (&consulApi.QueryOptions{WaitIndex: s.LastIndex, WaitTime: s.WaitTime}).WithContext(ctx)
 
 	KVPair, _, err := s.client.KV().Get(fieldName, QueryOpt)
 	if err != nil {
@@ -99,3 +142,8 @@ func (s *StoreKV) LoadConfig(fieldName string) (map[string]string, bool, error)
 func (s *StoreKV) LoadTopics() (map[string]string, bool, error) {
 	return s.LoadConfig(topicsPathInKV)
 }
+
+// LoadTopicsContext получает список топиков из consul с возможностью отмены запроса.
+func (s *StoreKV) LoadTopicsContext(ctx context.Context) (map[string]string, bool, error) {
+	return s.LoadConfigContext(ctx, topicsPathInKV)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 )
 
@@ -8,14 +9,14 @@ func TestMakeKVClient(t *testing.T) {
 	c := MakeKVClient()
 
 	if c.LastIndex != 0 {
-		t.Errorf("LastIndex при создании клиента должен быть равен 0, а равен %v", c.LastIndex )
+		t.Errorf("LastIndex при создании клиента должен быть равен 0, а равен %v", c.LastIndex)
 	}
 }
 
 func TestReadSettings(t *testing.T) {
 
 	savedFunc := readSettingsFile
-	defer func() {readSettingsFile = savedFunc}()
+	defer func() { readSettingsFile = savedFunc }()
 
 	readSettingsFile = func(filePath string) ([]byte, error) {
 		configFile := `{
@@ -61,4 +62,51 @@ func TestConnect(t *testing.T) {
 	} else if s.client != c {
 		t.Errorf("Созданный клиент не соответствует клиенту в структуре StoreKV")
 	}
-}
\ No newline at end of file
+}
+
+func TestReadAppSettings(t *testing.T) {
+	savedFunc := readSettingsFile
+	defer func() { readSettingsFile = savedFunc }()
+
+	readSettingsFile = func(filePath string) ([]byte, error) {
+		return nil, os.ErrNotExist
+	}
+
+	cfg, err := ReadAppSettings()
+	if err != nil {
+		t.Errorf("При отсутствии файла настроек не должна возникать ошибка: %s", err)
+	}
+	if cfg == nil || cfg.Engine.Default.Engine != "" || cfg.Message.Timestamp.Precision != 3 {
+		t.Errorf("При отсутствии файла настроек должны возвращаться настройки по умолчанию: %v", cfg)
+	}
+
+	readSettingsFile = func(filePath string) ([]byte, error) {
+		configFile := `{"engine": {
+  "default": {"engine": "MergeTree", "orderBy": "(client, device)"},
+  "tables": {"temp_out": {"ttl": "timestamp + INTERVAL 1 MONTH"}}}}`
+
+		return []byte(configFile), nil
+	}
+
+	cfg, err = ReadAppSettings()
+	if err != nil {
+		t.Errorf("Не удалось прочитать файл с настройками: %s", err)
+	}
+
+	if cfg.Engine.Default.Engine != "MergeTree" || cfg.Engine.Default.OrderBy != "(client, device)" {
+		t.Errorf("Неверно прочитаны общие настройки движка: %v", cfg.Engine.Default)
+	}
+
+	if cfg.Engine.Tables["temp_out"].TTL != "timestamp + INTERVAL 1 MONTH" {
+		t.Errorf("Неверно прочитаны настройки движка таблицы: %v", cfg.Engine.Tables)
+	}
+
+	readSettingsFile = func(filePath string) ([]byte, error) {
+		return []byte("{"), nil
+	}
+
+	_, err = ReadAppSettings()
+	if err == nil {
+		t.Errorf("При некорректном файле настроек должна возникать ошибка")
+	}
+}
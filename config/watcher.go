@@ -0,0 +1,74 @@
+package config
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// TopicWatcher следит за списком топиков в consul и передает его изменения в onChange.
+// При недоступности consul сохраняется последний полученный список топиков.
+type TopicWatcher struct {
+	load       func(ctx context.Context) (map[string]string, bool, error)
+	onChange   func(topics map[string]string)
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// MakeTopicWatcher возвращает объект для отслеживания топиков.
+// minBackoff и maxBackoff ограничивают паузу между запросами после ошибки.
+func MakeTopicWatcher(store *StoreKV, minBackoff, maxBackoff time.Duration,
+	onChange func(topics map[string]string)) *TopicWatcher {
+
+	return &TopicWatcher{
+		load:       store.LoadTopicsContext,
+		onChange:   onChange,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// Run получает топики из consul блокирующими запросами до отмены ctx.
+func (w *TopicWatcher) Run(ctx context.Context) {
+	backoff := w.minBackoff
+
+	for {
+		topics, ok, err := w.load(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			delay := withJitter(backoff)
+			log.Printf("Не удалось получить топики из consul, повтор через %s: %s", delay, err)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			backoff *= 2
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+			continue
+		}
+
+		backoff = w.minBackoff
+		if ok {
+			w.onChange(topics)
+		}
+	}
+}
+
+// withJitter возвращает случайную задержку от половины до полного значения backoff,
+// чтобы экземпляры приложения не обращались к consul одновременно.
+func withJitter(backoff time.Duration) time.Duration {
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
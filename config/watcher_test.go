@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type loadResult struct {
+	topics map[string]string
+	ok     bool
+	err    error
+}
+
+func TestTopicWatcherRun(t *testing.T) {
+	results := []loadResult{
+		{topics: map[string]string{"temp": "/+/+/out/sensors/temp_out"}, ok: true},
+		{err: fmt.Errorf("consul недоступен")},
+		{topics: map[string]string{"temp": "/+/+/out/sensors/temp_out"}, ok: false},
+		{topics: map[string]string{"hum": "/+/+/out/sensors/hum_out"}, ok: true},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	var changes []map[string]string
+
+	w := MakeTopicWatcher(&StoreKV{}, time.Millisecond, 2*time.Millisecond, func(topics map[string]string) {
+		changes = append(changes, topics)
+	})
+	w.load = func(ctx context.Context) (map[string]string, bool, error) {
+		if calls == len(results) {
+			cancel()
+			return nil, false, ctx.Err()
+		}
+		result := results[calls]
+		calls++
+		return result.topics, result.ok, result.err
+	}
+
+	w.Run(ctx)
+
+	if calls != len(results) {
+		t.Errorf("Количество запросов к consul. Ожидание: %v, факт: %v", len(results), calls)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Изменения должны передаваться только при изменении топиков, передано %v", len(changes))
+	}
+
+	if changes[1]["hum"] != "/+/+/out/sensors/hum_out" {
+		t.Errorf("Передан неверный список топиков: %v", changes[1])
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	backoff := time.Second
+
+	for i := 0; i < 100; i++ {
+		delay := withJitter(backoff)
+		if delay < backoff/2 || delay > backoff {
+			t.Errorf("Задержка %s должна быть от %s до %s", delay, backoff/2, backoff)
+		}
+	}
+
+	if withJitter(0) != 0 {
+		t.Errorf("Нулевая задержка не должна изменяться")
+	}
+}
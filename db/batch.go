@@ -0,0 +1,244 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"mqtt2clickhouse/message"
+	"sync"
+	"time"
+)
+
+// batch содержит накопленные для одной таблицы строки и сообщения, из которых они получены.
+type batch struct {
+	fieldsType []message.ColumnsType
+	rows       [][]message.Pair
+	messages   []*message.Message
+}
+
+// addMessage запоминает сообщение, из которого получена строка пакета.
+func (b *batch) addMessage(msg *message.Message) {
+	if msg == nil {
+		return
+	}
+	if n := len(b.messages); n > 0 && b.messages[n-1] == msg {
+		return
+	}
+	b.messages = append(b.messages, msg)
+}
+
+// tableBatch пакет строк, готовый к записи в таблицу.
+type tableBatch struct {
+	tableName string
+	*batch
+}
+
+// FailureHandler получает сообщения, строки которых не удалось записать в БД, и ошибку записи.
+type FailureHandler func(messages []*message.Message, err error)
+
+// BatchWriter накапливает записи по таблицам и записывает их в БД одним запросом INSERT
+// при достижении лимита количества строк или по истечении интервала.
+// Пакеты записываются без блокировки накопления, поэтому повторные попытки записи не останавливают AddAll.
+type BatchWriter struct {
+	explorer  *ExplorerDB
+	size      int
+	interval  time.Duration
+	retry     RetrySettings
+	onFailure FailureHandler
+	batches   map[string]*batch
+	mu        sync.Mutex
+	writeMu   sync.Mutex
+	started   bool
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// MakeBatchWriter возвращает объект для пакетной записи в БД.
+// size - максимальное количество строк в одном запросе, interval - максимальное время ожидания записи.
+func MakeBatchWriter(explorer *ExplorerDB, size int, interval time.Duration) *BatchWriter {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &BatchWriter{
+		explorer: explorer,
+		size:     size,
+		interval: interval,
+		retry:    RetrySettings{Attempts: 1},
+		batches:  make(map[string]*batch),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetRetrySettings задает повторные попытки записи при временных ошибках БД.
+func (b *BatchWriter) SetRetrySettings(retry RetrySettings) {
+	b.retry = retry
+}
+
+// SetFailureHandler задает обработчик сообщений, строки которых не удалось записать в БД.
+// Без обработчика ошибки записи только логируются.
+func (b *BatchWriter) SetFailureHandler(handler FailureHandler) {
+	b.onFailure = handler
+}
+
+// Start запускает периодическую запись накопленных данных и данных из буфера ExplorerDB.
+// Сообщения строк, которые не удалось записать из буфера, также передаются в обработчик ошибок.
+func (b *BatchWriter) Start() {
+	if b.started || b.interval <= 0 {
+		return
+	}
+	b.started = true
+
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.Flush(); err != nil {
+					log.Printf("Ошибка при записи накопленных данных: %s", err)
+				}
+				if err := b.explorer.ReplaySpool(b.onFailure); err != nil {
+					log.Printf("Ошибка при записи данных из буфера: %s", err)
+				}
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Add проверяет запись и добавляет ее в очередь на запись в таблицу.
+func (b *BatchWriter) Add(data message.DataRecord) error {
+	return b.AddAll(nil, []message.DataRecord{data})
+}
+
+// AddAll проверяет записи сообщения msg и добавляет их в очередь на запись.
+// Возвращает ошибку, если хотя бы одна запись не прошла проверку, в этом случае ни одна запись не добавляется.
+// Лимит строк проверяется после добавления всех записей, поэтому строки одного сообщения
+// записываются в таблицу одним запросом INSERT. Ошибки записи пакетов передаются в обработчик ошибок.
+// Если схему таблиц не удалось проверить из-за недоступности БД, записи сохраняются в буфер ExplorerDB.
+func (b *BatchWriter) AddAll(msg *message.Message, records []message.DataRecord) error {
+	tables := make([]string, len(records))
+	fieldsTypes := make([][]message.ColumnsType, len(records))
+	rows := make([][]message.Pair, len(records))
+
+	for i, data := range records {
+		err := b.retry.do(func() error {
+			var err error
+			tables[i], fieldsTypes[i], rows[i], err = b.explorer.prepareRecord(data)
+			return err
+		})
+		if err != nil {
+			return b.explorer.deferRecords(msg, records, err)
+		}
+	}
+
+	b.mu.Lock()
+
+	var ready []tableBatch
+	for i, tableName := range tables {
+		current, ok := b.batches[tableName]
+		if ok && !sameColumns(current.fieldsType, fieldsTypes[i]) {
+			// Строки с другим набором колонок нельзя записать одним запросом.
+			ready = append(ready, tableBatch{tableName: tableName, batch: current})
+			ok = false
+		}
+
+		if !ok {
+			current = &batch{fieldsType: fieldsTypes[i]}
+			b.batches[tableName] = current
+		}
+		current.rows = append(current.rows, rows[i])
+		current.addMessage(msg)
+	}
+
+	for tableName, current := range b.batches {
+		if len(current.rows) >= b.size {
+			ready = append(ready, tableBatch{tableName: tableName, batch: current})
+			delete(b.batches, tableName)
+		}
+	}
+
+	if len(ready) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	// Блокировка записи берется до снятия блокировки накопления, чтобы пакеты таблицы записывались по порядку.
+	b.writeMu.Lock()
+	b.mu.Unlock()
+	defer b.writeMu.Unlock()
+
+	for _, item := range ready {
+		if err := b.writeBatch(item); err != nil {
+			log.Printf("Ошибка при записи накопленных данных: %s", err)
+		}
+	}
+	return nil
+}
+
+// Flush записывает в БД все накопленные данные.
+func (b *BatchWriter) Flush() error {
+	b.mu.Lock()
+	ready := make([]tableBatch, 0, len(b.batches))
+	for tableName, current := range b.batches {
+		ready = append(ready, tableBatch{tableName: tableName, batch: current})
+	}
+	b.batches = make(map[string]*batch)
+
+	b.writeMu.Lock()
+	b.mu.Unlock()
+	defer b.writeMu.Unlock()
+
+	var firstErr error
+	for _, item := range ready {
+		if err := b.writeBatch(item); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Close останавливает периодическую запись и записывает оставшиеся данные.
+func (b *BatchWriter) Close() error {
+	if b.started {
+		close(b.quit)
+		<-b.done
+		b.started = false
+	}
+	return b.Flush()
+}
+
+// writeBatch записывает пакет строк таблицы. Вызывается под блокировкой записи.
+// Если пакет записать не удалось, его сообщения передаются в обработчик ошибок.
+func (b *BatchWriter) writeBatch(item tableBatch) error {
+	err := b.explorer.storeData(item.tableName, item.fieldsType, item.rows, item.messages, b.retry)
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("Не удалось записать %v строк в таблицу %s: %w", len(item.rows), item.tableName, err)
+	if b.onFailure != nil {
+		b.onFailure(item.messages, err)
+	}
+	return err
+}
+
+// sameColumns проверяет совпадение названий колонок двух записей.
+func sameColumns(a, b []message.ColumnsType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].ColName != b[i].ColName {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"mqtt2clickhouse/message"
+	"strings"
+	"testing"
+	"time"
+)
+
+// badConnDriver драйвер database/sql, подключение которого всегда завершается ошибкой driver.ErrBadConn.
+type badConnDriver struct{}
+
+func (badConnDriver) Open(string) (driver.Conn, error) { return nil, driver.ErrBadConn }
+
+func init() {
+	sql.Register("badconn", badConnDriver{})
+}
+
+// makeTestExplorer возвращает ExplorerDB с таблицей data (колонки value и extra), записывающий через драйвер d.
+func makeTestExplorer(d *testDriver) *ExplorerDB {
+	e := &ExplorerDB{driver: d, tablesFromDB: &tablesInfo{"data": {
+		{ColumnsType: message.ColumnsType{ColName: "value", ColType: "Int64"}},
+		{ColumnsType: message.ColumnsType{ColName: "extra", ColType: "Int64"}},
+	}}}
+	e.replicas.replicas = makeTestReplicas(true)
+	return e
+}
+
+// makeTestRecord возвращает запись таблицы data. Если extra, в записи есть колонка extra.
+func makeTestRecord(value int64, extra bool) message.DataRecord {
+	fieldsType := []message.ColumnsType{{ColName: "value", ColType: "Int64"}}
+	fields := []message.Pair{{Name: "value", Value: value}}
+	if extra {
+		fieldsType = append(fieldsType, message.ColumnsType{ColName: "extra", ColType: "Int64"})
+		fields = append(fields, message.Pair{Name: "extra", Value: value})
+	}
+	return message.DataRecord{"tableName": "data", "fieldsType": fieldsType, "fields": fields}
+}
+
+func TestBatchWriterSize(t *testing.T) {
+	d := &testDriver{}
+	writer := MakeBatchWriter(makeTestExplorer(d), 3, 0)
+
+	for i := 0; i < 5; i++ {
+		if err := writer.AddAll(nil, []message.DataRecord{makeTestRecord(int64(i), false)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if written := d.written(); written != "[data:3]" {
+		t.Errorf("При достижении лимита строк должен быть записан пакет. Факт: %s", written)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if written := d.written(); written != "[data:3 data:2]" {
+		t.Errorf("При закрытии должны быть записаны оставшиеся строки. Факт: %s", written)
+	}
+}
+
+func TestBatchWriterColumnsChange(t *testing.T) {
+	d := &testDriver{}
+	writer := MakeBatchWriter(makeTestExplorer(d), 10, 0)
+
+	records := []message.DataRecord{makeTestRecord(1, false), makeTestRecord(2, false), makeTestRecord(3, true)}
+	if err := writer.AddAll(nil, records); err != nil {
+		t.Fatal(err)
+	}
+	if written := d.written(); written != "[data:2]" {
+		t.Errorf("При изменении колонок должен быть записан накопленный пакет. Факт: %s", written)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if written := d.written(); written != "[data:2 data:1]" {
+		t.Errorf("Факт: %s", written)
+	}
+}
+
+func TestBatchWriterInterval(t *testing.T) {
+	d := &testDriver{}
+	writer := MakeBatchWriter(makeTestExplorer(d), 100, 10*time.Millisecond)
+	writer.Start()
+	defer writer.Close()
+
+	records := []message.DataRecord{makeTestRecord(1, false), makeTestRecord(2, false)}
+	if err := writer.AddAll(nil, records); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for d.written() != "[data:2]" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if written := d.written(); written != "[data:2]" {
+		t.Errorf("Накопленные строки должны быть записаны по истечении интервала. Факт: %s", written)
+	}
+}
+
+func TestBatchWriterFailure(t *testing.T) {
+	d := &testDriver{err: fmt.Errorf("Синтаксическая ошибка")}
+	writer := MakeBatchWriter(makeTestExplorer(d), 3, 0)
+
+	var failed []*message.Message
+	var failErr error
+	writer.SetFailureHandler(func(messages []*message.Message, err error) {
+		failed = append(failed, messages...)
+		failErr = err
+	})
+
+	first := &message.Message{Topic: "first"}
+	second := &message.Message{Topic: "second"}
+	if err := writer.AddAll(first, []message.DataRecord{makeTestRecord(1, false), makeTestRecord(2, false)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddAll(second, []message.DataRecord{makeTestRecord(3, false)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failed) != 2 || failed[0] != first || failed[1] != second || failErr == nil {
+		t.Errorf("Сообщения пакета с ошибкой записи должны быть переданы в обработчик: %v, ошибка %v", failed, failErr)
+	}
+}
+
+func TestBatchWriterAddDuringWrite(t *testing.T) {
+	d := &testDriver{block: make(chan struct{}), entered: make(chan struct{}, 1)}
+	writer := MakeBatchWriter(makeTestExplorer(d), 10, 0)
+
+	if err := writer.AddAll(nil, []message.DataRecord{makeTestRecord(1, false)}); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- writer.Flush() }()
+	<-d.entered
+
+	added := make(chan error, 1)
+	go func() { added <- writer.AddAll(nil, []message.DataRecord{makeTestRecord(2, false)}) }()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Запись пакета не должна блокировать добавление записей")
+	}
+
+	close(d.block)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	d.block = nil
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if written := d.written(); written != "[data:1 data:1]" {
+		t.Errorf("Факт: %s", written)
+	}
+}
+
+func TestBatchWriterDeferRecords(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	d := &testDriver{}
+	e := makeTestExplorer(d)
+	e.spool = spool
+	connect, err := sql.Open("badconn", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.replicas.replicas = []*replica{{dataSource: "replica0", connect: connect, healthy: true}}
+
+	// Схема таблицы other неизвестна, а БД недоступна.
+	record := makeTestRecord(1, false)
+	record["tableName"] = "other"
+	msg := &message.Message{Topic: "other"}
+	if err := MakeBatchWriter(e, 1, 0).AddAll(msg, []message.DataRecord{record}); err != nil {
+		t.Fatalf("Записи должны сохраняться в буфер при недоступности БД: %s", err)
+	}
+	if !spool.Pending() {
+		t.Fatalf("Записи должны быть сохранены в буфер")
+	}
+
+	var failed []*message.Message
+	onFailure := func(messages []*message.Message, err error) { failed = append(failed, messages...) }
+
+	if err := e.ReplaySpool(onFailure); err == nil || !spool.Pending() {
+		t.Errorf("Пока БД недоступна, записи должны оставаться в буфере: %v", err)
+	}
+
+	e.mu.Lock()
+	(*e.tablesFromDB)["other"] = []columnInfo{{ColumnsType: message.ColumnsType{ColName: "value", ColType: "Int64"}}}
+	e.mu.Unlock()
+
+	if err := e.ReplaySpool(onFailure); err != nil || spool.Pending() {
+		t.Errorf("После восстановления БД записи должны быть записаны из буфера: %v", err)
+	}
+	if d.written() != "[other:1]" || !strings.HasSuffix(d.tokens[0], "-0") || len(failed) != 0 {
+		t.Errorf("Неверная запись из буфера: %s, ключи %v, отклонено %v", d.written(), d.tokens, failed)
+	}
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mqtt2clickhouse/message"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Режимы приведения значений записи к типу колонки таблицы.
+const (
+	CoercionStrict     = "strict"
+	CoercionLenient    = "lenient"
+	CoercionBestEffort = "best-effort"
+)
+
+// intTypeRe выделяет признак беззнакового типа и разрядность из целочисленного типа колонки.
+var intTypeRe = regexp.MustCompile(`^(U?)Int(8|16|32|64)$`)
+
+// coerce приводит значение к типу колонки colType.
+// В режиме lenient выполняются только преобразования без потери данных: строка в число, целое число
+// в дробное, число в строку, логическое значение в UInt8, unix время во время.
+// В режиме best-effort дробные числа округляются, а любые значения записываются в строковые колонки.
+func coerce(value interface{}, colType string, mode string) (interface{}, error) {
+	if mode != CoercionLenient && mode != CoercionBestEffort {
+		return nil, fmt.Errorf("Приведение типов выключено\n")
+	}
+	bestEffort := mode == CoercionBestEffort
+
+	baseType, nullable := unwrapType(colType, "Nullable")
+	baseType, _ = unwrapType(baseType, "LowCardinality")
+
+	if value == nil {
+		if nullable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Значение null нельзя записать в колонку %s\n", colType)
+	}
+
+	if tokens := intTypeRe.FindStringSubmatch(baseType); tokens != nil {
+		bits, _ := strconv.Atoi(tokens[2])
+		return toInteger(value, tokens[1] == "U", bits, bestEffort)
+	}
+
+	switch {
+	case strings.HasPrefix(baseType, "Float"), strings.HasPrefix(baseType, "Decimal"):
+		return toFloat(value, bestEffort)
+	case baseType == "String", strings.HasPrefix(baseType, "FixedString"):
+		return toString(value, bestEffort)
+	case baseType == "Bool":
+		return toBool(value, bestEffort)
+	case strings.HasPrefix(baseType, "DateTime"):
+		if t, ok := value.(time.Time); ok {
+			return t, nil
+		}
+		return message.ParseTimestamp(value)
+	}
+
+	return nil, fmt.Errorf("Приведение к типу %s не поддерживается\n", colType)
+}
+
+// toInteger приводит значение к целому числу с разрядностью bits.
+func toInteger(value interface{}, unsigned bool, bits int, bestEffort bool) (interface{}, error) {
+	var f float64
+	switch v := value.(type) {
+	case int64:
+		return checkIntRange(v, unsigned, bits)
+	case float64:
+		f = v
+	case bool:
+		if v {
+			return checkIntRange(1, unsigned, bits)
+		}
+		return checkIntRange(0, unsigned, bits)
+	case string:
+		s := strings.TrimSpace(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return checkIntRange(i, unsigned, bits)
+		}
+		if unsigned {
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil && bits == 64 {
+				return u, nil
+			}
+		}
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Строка '%s' не является числом\n", v)
+		}
+		f = parsed
+	default:
+		return nil, fmt.Errorf("Значение %v нельзя привести к целому числу\n", value)
+	}
+
+	if f != math.Trunc(f) {
+		if !bestEffort {
+			return nil, fmt.Errorf("Число %v не является целым\n", f)
+		}
+		f = math.Round(f)
+	}
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("Число %v выходит за пределы Int64\n", f)
+	}
+	return checkIntRange(int64(f), unsigned, bits)
+}
+
+// checkIntRange проверяет, что целое число помещается в тип колонки.
+func checkIntRange(i int64, unsigned bool, bits int) (interface{}, error) {
+	if unsigned {
+		if i < 0 || (bits < 64 && uint64(i) >= uint64(1)<<uint(bits)) {
+			return nil, fmt.Errorf("Число %v выходит за пределы UInt%d\n", i, bits)
+		}
+		return uint64(i), nil
+	}
+
+	if bits < 64 && (i < -(int64(1)<<uint(bits-1)) || i >= int64(1)<<uint(bits-1)) {
+		return nil, fmt.Errorf("Число %v выходит за пределы Int%d\n", i, bits)
+	}
+	return i, nil
+}
+
+// toFloat приводит значение к дробному числу.
+func toFloat(value interface{}, bestEffort bool) (interface{}, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		if !bestEffort && (v > 1<<53 || v < -(1<<53)) {
+			return nil, fmt.Errorf("Число %v нельзя точно записать в дробное число\n", v)
+		}
+		return float64(v), nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Строка '%s' не является числом\n", v)
+		}
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("Значение %v нельзя привести к дробному числу\n", value)
+}
+
+// toString приводит значение к строке.
+func toString(value interface{}, bestEffort bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+
+	if !bestEffort {
+		return nil, fmt.Errorf("Значение %v нельзя привести к строке\n", value)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+// toBool приводит значение к логическому значению.
+func toBool(value interface{}, bestEffort bool) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		if v == 0 || v == 1 || bestEffort {
+			return v != 0, nil
+		}
+	case float64:
+		if v == 0 || v == 1 || bestEffort {
+			return v != 0, nil
+		}
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Значение %v нельзя привести к логическому значению\n", value)
+}
+
+// unwrapType возвращает тип без обертки wrapper, например Nullable, и признак ее наличия.
+func unwrapType(colType, wrapper string) (string, bool) {
+	prefix := wrapper + "("
+	if strings.HasPrefix(colType, prefix) && strings.HasSuffix(colType, ")") {
+		return colType[len(prefix) : len(colType)-1], true
+	}
+	return colType, false
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCoerce(t *testing.T) {
+	timestamp := time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)
+
+	type testVariant struct {
+		value   interface{}
+		colType string
+		mode    string
+		result  interface{}
+		isErr   bool
+	}
+
+	testVariants := []*testVariant{
+		{value: "12.5", colType: "Float64", mode: CoercionLenient, result: 12.5},
+		{value: int64(1), colType: "Float64", mode: CoercionLenient, result: 1.0},
+		{value: int64(1), colType: "Float64", mode: CoercionStrict, isErr: true},
+		{value: 27.8, colType: "String", mode: CoercionLenient, result: "27.8"},
+		{value: true, colType: "UInt8", mode: CoercionLenient, result: uint64(1)},
+		{value: "42", colType: "Int32", mode: CoercionLenient, result: int64(42)},
+		{value: "abc", colType: "Int32", mode: CoercionLenient, isErr: true},
+		{value: int64(300), colType: "UInt8", mode: CoercionBestEffort, isErr: true},
+		{value: int64(-1), colType: "UInt16", mode: CoercionLenient, isErr: true},
+		{value: 12.5, colType: "Int64", mode: CoercionLenient, isErr: true},
+		{value: 12.5, colType: "Int64", mode: CoercionBestEffort, result: int64(13)},
+		{value: int64(1637785643), colType: "DateTime", mode: CoercionLenient, result: timestamp},
+		{value: int64(1637785643000), colType: "DateTime64(3)", mode: CoercionLenient, result: timestamp},
+		{value: "2021-11-24T20:27:23Z", colType: "Nullable(DateTime)", mode: CoercionLenient, result: timestamp},
+		{value: "true", colType: "Bool", mode: CoercionLenient, result: true},
+		{value: int64(2), colType: "Bool", mode: CoercionLenient, isErr: true},
+		{value: []interface{}{int64(1)}, colType: "String", mode: CoercionLenient, isErr: true},
+		{value: []interface{}{int64(1)}, colType: "LowCardinality(String)", mode: CoercionBestEffort, result: "[1]"},
+		{value: nil, colType: "Nullable(Float64)", mode: CoercionLenient, result: nil},
+		{value: nil, colType: "Float64", mode: CoercionLenient, isErr: true},
+		{value: "1", colType: "UUID", mode: CoercionBestEffort, isErr: true},
+	}
+
+	for i, v := range testVariants {
+		result, err := coerce(v.value, v.colType, v.mode)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+			continue
+		}
+		if !v.isErr && !reflect.DeepEqual(result, v.result) {
+			t.Errorf("№%v. Ожидание: %v (%T), факт: %v (%T)", i, v.result, v.result, result, result)
+		}
+	}
+}
@@ -4,84 +4,268 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	_ "github.com/mailru/go-clickhouse"
 	"log"
 	"mqtt2clickhouse/message"
+	"mqtt2clickhouse/metrics"
 	"strings"
 	"sync"
+	"time"
 )
 
+// untypedNullType тип колонки, который сообщение указывает для null без заданного типа колонки.
+const untypedNullType = "Nullable(String)"
+
+// Виды выражений по умолчанию для колонок, значения которых вычисляются в БД и не могут быть записаны.
+const (
+	defaultMaterialized = "MATERIALIZED"
+	defaultAlias        = "ALIAS"
+)
+
+// errUnknownTable код ошибки ClickHouse UNKNOWN_TABLE.
+const errUnknownTable = 60
+
+// staleSchemaCodes коды ошибок ClickHouse, после которых сохраненная схема таблицы считается устаревшей.
+var staleSchemaCodes = map[int]bool{
+	8:               true, // THERE_IS_NO_COLUMN
+	16:              true, // NO_SUCH_COLUMN_IN_TABLE
+	47:              true, // UNKNOWN_IDENTIFIER
+	errUnknownTable: true, // UNKNOWN_TABLE
+}
+
+// columnInfo описание колонки таблицы БД и вида ее выражения по умолчанию (DEFAULT, MATERIALIZED, ALIAS).
+type columnInfo struct {
+	message.ColumnsType
+	defaultKind string
+}
+
+// insertable проверяет, можно ли записать значение в колонку.
+func (c columnInfo) insertable() bool {
+	return c.defaultKind != defaultMaterialized && c.defaultKind != defaultAlias
+}
+
 // tablesInfo схема таблиц БД.
-type tablesInfo map[string][]message.ColumnsType
+type tablesInfo map[string][]columnInfo
 
 // ExplorerDB хранит подключение к БД и схему ее таблиц.
 type ExplorerDB struct {
-	connect      *sql.DB
+	replicas     replicaSet
+	driver       Driver
 	tablesFromDB *tablesInfo
+	engines      EngineSettings
+	schema       SchemaSettings
+	spool        *Spool
+	database     string
 	mu           sync.RWMutex
 }
 
-// Connect выполняет подключение к базе данных.
-func (e *ExplorerDB) Connect(dataSource string) error {
-	errMessage := "Не удалось подключится к базе %s по причине %s\n"
-	var err error
+// SetEngineSettings задает движок и параметры для автоматически создаваемых таблиц.
+func (e *ExplorerDB) SetEngineSettings(settings EngineSettings) error {
+	if err := settings.validate(); err != nil {
+		return fmt.Errorf("Некорректные настройки движка таблиц: %s", err)
+	}
+
+	e.engines = settings
+	return nil
+}
+
+// SetSchemaSettings задает изменение схемы существующих таблиц под новые записи.
+func (e *ExplorerDB) SetSchemaSettings(settings SchemaSettings) error {
+	if err := settings.validate(); err != nil {
+		return fmt.Errorf("Некорректные настройки изменения схемы таблиц: %s", err)
+	}
 
-	e.connect, err = sql.Open("clickhouse", dataSource)
+	e.schema = settings
+	return nil
+}
+
+// SetDriver задает драйвер подключения к БД: http (по умолчанию) или native.
+func (e *ExplorerDB) SetDriver(name string) error {
+	d, err := driverByName(name)
 	if err != nil {
-		return fmt.Errorf(errMessage, dataSource, err)
+		return err
+	}
+
+	e.driver = d
+	return nil
+}
+
+// SetSpool задает буфер для записей на время недоступности БД. Вызывается после SetEngineSettings.
+func (e *ExplorerDB) SetSpool(spool *Spool) error {
+	if spool != nil {
+		if err := e.engines.validateDeduplication(); err != nil {
+			return fmt.Errorf("Буфер записей нельзя использовать с настройками движка таблиц: %s", err)
+		}
+	}
+
+	e.spool = spool
+	return nil
+}
+
+// SetBalance задает стратегию выбора реплики БД: first-healthy (по умолчанию) или round-robin.
+func (e *ExplorerDB) SetBalance(balance string) error {
+	if err := validateBalance(balance); err != nil {
+		return err
+	}
+
+	e.replicas.mu.Lock()
+	e.replicas.balance = balance
+	e.replicas.mu.Unlock()
+	return nil
+}
+
+// Connect выполняет подключение к репликам базы данных.
+// Подключение успешно, если доступна хотя бы одна реплика, остальные реплики проверяются повторно в Ping.
+// Если драйвер не задан, используется драйвер http.
+func (e *ExplorerDB) Connect(dataSources ...string) error {
+	errMessage := "Не удалось подключится к базе %s по причине %s\n"
+
+	if len(dataSources) == 0 {
+		return fmt.Errorf("Не указан адрес БД\n")
+	}
+	if e.driver == nil {
+		if err := e.SetDriver(DriverHTTP); err != nil {
+			return err
+		}
+	}
+
+	replicas := make([]*replica, 0, len(dataSources))
+	closeAll := func() {
+		for _, rep := range replicas {
+			_ = rep.connect.Close()
+		}
 	}
-	if err := e.connect.Ping(); err != nil {
-		return fmt.Errorf(errMessage, dataSource, err)
+
+	var lastErr error
+	for _, dataSource := range dataSources {
+		connect, err := e.driver.Open(dataSource)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf(errMessage, dataSource, err)
+		}
+
+		rep := &replica{dataSource: dataSource, connect: connect}
+		replicas = append(replicas, rep)
+
+		if err := connect.Ping(); err != nil {
+			lastErr = fmt.Errorf(errMessage, dataSource, err)
+			log.Print(lastErr)
+			continue
+		}
+		rep.healthy = true
+		log.Printf("Подключение к базе %s успешно завершено.\n", dataSource)
 	}
 
-	log.Printf("Подключение к базе %s успешно завершено.\n", dataSource)
+	healthy := false
+	for _, rep := range replicas {
+		healthy = healthy || rep.healthy
+	}
+	if !healthy {
+		closeAll()
+		return lastErr
+	}
+
+	e.replicas.mu.Lock()
+	e.replicas.replicas = replicas
+	e.replicas.mu.Unlock()
 	return nil
 }
 
-// CloseConnect закрывает соединение с базой данных.
+// Ping проверяет доступность реплик базы данных и обновляет их состояние.
+// Возвращает ошибку, если недоступны все реплики.
+func (e *ExplorerDB) Ping() error {
+	err := fmt.Errorf("Нет подключения к БД\n")
+	healthy := false
+
+	for _, rep := range e.replicas.all() {
+		pingErr := rep.connect.Ping()
+		e.replicas.setHealthy(rep, pingErr == nil)
+		if pingErr != nil {
+			err = fmt.Errorf("Реплика %s недоступна: %s", rep.dataSource, pingErr)
+			continue
+		}
+		healthy = true
+	}
+
+	if healthy {
+		return nil
+	}
+	return err
+}
+
+// CloseConnect закрывает соединения с репликами базы данных.
 func (e *ExplorerDB) CloseConnect() {
-	err := e.connect.Close()
-	if err != nil {
-		log.Fatal("Ошибка при завершении соединания с БД.")
+	for _, rep := range e.replicas.all() {
+		err := rep.connect.Close()
+		if err != nil {
+			log.Fatal("Ошибка при завершении соединания с БД.")
+		}
 	}
 }
 
-// showTables возвращает список таблиц в БД.
+// showTables возвращает список таблиц базы данных подключения.
 func (e *ExplorerDB) showTables() (*tablesInfo, error) {
 	tablesFromDB := tablesInfo{}
-	rows, err := e.connect.Query("SHOW TABLES")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	err := e.withReplica(func(connect *sql.DB) error {
+		rows, err := connect.Query(fmt.Sprintf("SHOW TABLES FROM %s", quoteIdentifier(e.database)))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	for rows.Next() {
-		var tableName string
+		for rows.Next() {
+			var tableName string
 
-		err := rows.Scan(&tableName)
-		if err != nil {
-			return nil, err
+			err := rows.Scan(&tableName)
+			if err != nil {
+				return err
+			}
+			tablesFromDB[tableName] = nil
 		}
-		tablesFromDB[tableName] = nil
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &tablesFromDB, nil
 }
 
 // showColumns получает колонки и их типы для каждый таблицы БД и возвращает обновленный список таблиц.
+// Таблицы, удаленные после получения списка, пропускаются.
 func (e *ExplorerDB) showColumns(tablesFromDB *tablesInfo) (*tablesInfo, error) {
 
 	for tableName := range *tablesFromDB {
-		textQuery := fmt.Sprintf("DESCRIBE TABLE temp_out %s", tableName)
-		rows, err := e.connect.Query(textQuery)
+		columnsFromDB, err := e.describeTable(tableName)
+		if code, ok := serverErrorCode(err); ok && code == errUnknownTable {
+			delete(*tablesFromDB, tableName)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		columnsFromDB := make([]message.ColumnsType, 0)
+		(*tablesFromDB)[tableName] = columnsFromDB
+
+	}
+	return tablesFromDB, nil
+}
+
+// describeTable возвращает колонки таблицы базы данных подключения.
+func (e *ExplorerDB) describeTable(tableName string) ([]columnInfo, error) {
+	textQuery := fmt.Sprintf("DESCRIBE TABLE %s.%s", quoteIdentifier(e.database), quoteIdentifier(tableName))
+	var columnsFromDB []columnInfo
+
+	err := e.withReplica(func(connect *sql.DB) error {
+		rows, err := connect.Query(textQuery)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		columnsFromDB = make([]columnInfo, 0)
 
 		for rows.Next() {
-			var column message.ColumnsType
+			var column columnInfo
 			var (
 				colDefaultType       sql.NullString
 				colDefaultExpression sql.NullString
@@ -99,24 +283,43 @@ func (e *ExplorerDB) showColumns(tablesFromDB *tablesInfo) (*tablesInfo, error)
 				&colCodecExpression,
 				&colTTLExpression)
 			if err != nil {
-				_ = rows.Close()
-				return nil, err
+				return err
 			}
 
+			column.defaultKind = colDefaultType.String
 			columnsFromDB = append(columnsFromDB, column)
 		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		_ = rows.Close()
-		(*tablesFromDB)[tableName] = columnsFromDB
+	return columnsFromDB, nil
+}
 
-	}
-	return tablesFromDB, nil
+// currentDatabase возвращает название базы данных подключения.
+func (e *ExplorerDB) currentDatabase() (string, error) {
+	var database string
+	err := e.withReplica(func(connect *sql.DB) error {
+		return connect.QueryRow("SELECT currentDatabase()").Scan(&database)
+	})
+	return database, err
 }
 
 // LoadTables записывапет схему таблиц БД в ExplorerDB.
+// Может вызываться периодически для обновления схемы таблиц, измененных в БД.
 func (e *ExplorerDB) LoadTables() error {
 	errMessage := "Не удалось получить схему базы данных. Причина: %s\n"
 
+	if e.database == "" {
+		database, err := e.currentDatabase()
+		if err != nil {
+			return fmt.Errorf(errMessage, err)
+		}
+		e.database = database
+	}
+
 	tablesFromDB, err := e.showTables()
 	if err != nil {
 		return fmt.Errorf(errMessage, err)
@@ -134,10 +337,39 @@ func (e *ExplorerDB) LoadTables() error {
 	return nil
 }
 
+// loadTable читает схему таблицы из БД и сохраняет ее в ExplorerDB.
+// Возвращает false, если таблицы нет в БД.
+func (e *ExplorerDB) loadTable(tableName string) ([]columnInfo, bool, error) {
+	columns, err := e.describeTable(tableName)
+	if code, ok := serverErrorCode(err); ok && code == errUnknownTable {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	e.mu.Lock()
+	(*e.tablesFromDB)[tableName] = columns
+	e.mu.Unlock()
+	return columns, true, nil
+}
+
+// invalidateTable удаляет сохраненную схему таблицы, чтобы при следующей записи она была прочитана из БД.
+func (e *ExplorerDB) invalidateTable(tableName string) {
+	e.mu.Lock()
+	delete(*e.tablesFromDB, tableName)
+	e.mu.Unlock()
+}
+
 // addTablesInfo добавляет схему таблицы БД в ExplorerDB.
 func (e *ExplorerDB) addTablesInfo(tableName string, tableColumns []message.ColumnsType) error {
+	columns := make([]columnInfo, len(tableColumns))
+	for i, column := range tableColumns {
+		columns[i] = columnInfo{ColumnsType: column}
+	}
+
 	e.mu.Lock()
-	(*e.tablesFromDB)[tableName] = tableColumns
+	(*e.tablesFromDB)[tableName] = columns
 	e.mu.Unlock()
 	return nil
 }
@@ -145,127 +377,272 @@ func (e *ExplorerDB) addTablesInfo(tableName string, tableColumns []message.Colu
 // Recording создает новую таблицу если ее нет в бд или проверяет валидность полей для записи.
 // Затем выполняет запись в бд.
 func (e *ExplorerDB) Recording(data message.DataRecord) error {
+	tableName, fieldsType, fields, err := e.prepareRecord(data)
+	if err != nil {
+		return err
+	}
+
+	// Запись данных в БД.
+	return e.storeData(tableName, fieldsType, [][]message.Pair{fields}, nil, RetrySettings{Attempts: 1})
+}
+
+// prepareRecord извлекает из записи название таблицы, описание и значения полей.
+// Создает новую таблицу если ее нет в бд или сопоставляет поля записи с колонками таблицы по названию.
+func (e *ExplorerDB) prepareRecord(data message.DataRecord) (string, []message.ColumnsType, []message.Pair, error) {
+	var err error
+
 	tableNameInterface, ok := data["tableName"]
 	if !ok {
-		return fmt.Errorf("Отсутствует поле tableName.\n")
+		return "", nil, nil, fmt.Errorf("Отсутствует поле tableName.\n")
 	}
 
 	tableName, ok := tableNameInterface.(string)
 	if !ok {
-		return fmt.Errorf("Поле tableName имеет неправильный формат.\n")
+		return "", nil, nil, fmt.Errorf("Поле tableName имеет неправильный формат.\n")
 	}
 
 	fieldsTypeInterface, ok := data["fieldsType"]
 	if !ok {
-		return fmt.Errorf("Отсутствует поле fieldsType.\n")
+		return "", nil, nil, fmt.Errorf("Отсутствует поле fieldsType.\n")
 	}
 
 	fieldsType, ok := fieldsTypeInterface.([]message.ColumnsType)
 	if !ok {
-		return fmt.Errorf("Поле fieldsType имеет неправильный формат.\n")
+		return "", nil, nil, fmt.Errorf("Поле fieldsType имеет неправильный формат.\n")
 	}
 
 	fieldsInterface, ok := data["fields"]
 	if !ok {
-		return fmt.Errorf("Отсутствует поле fields.\n")
+		return "", nil, nil, fmt.Errorf("Отсутствует поле fields.\n")
 	}
 
 	fields, ok := fieldsInterface.([]message.Pair)
 	if !ok {
-		return fmt.Errorf("Поле fields имеет неправильный формат.\n")
+		return "", nil, nil, fmt.Errorf("Поле fields имеет неправильный формат.\n")
 	}
 
 	// Проверка на наличие схемы таблицы.
 	e.mu.RLock()
 	tableInfo, ok := (*e.tablesFromDB)[tableName]
 	e.mu.RUnlock()
+	if !ok {
+		// Таблица могла быть создана или изменена в БД после загрузки схемы.
+		tableInfo, ok, err = e.loadTable(tableName)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
 	if ok {
-		err := e.checkValid(tableInfo, fieldsType)
+		var changes []schemaChange
+		fieldsType, fields, changes, err = e.schema.match(tableName, tableInfo, fieldsType, fields)
 		if err != nil {
-			return err
+			return "", nil, nil, err
+		}
+		err = e.applySchemaChanges(tableName, changes)
+		if err != nil {
+			return "", nil, nil, err
 		}
 	} else {
-		err := e.createTable(tableName, fieldsType)
+		engine := e.engines.forTable(tableName)
+		if e.spool != nil {
+			engine = engine.withDeduplication()
+		}
+		err := e.createTable(tableName, fieldsType, engine)
 		if err != nil {
-			return err
+			return "", nil, nil, err
 		}
 		err = e.addTablesInfo(tableName, fieldsType)
 		if err != nil {
-			return err
+			return "", nil, nil, err
 		}
 	}
 
-	// Запись данных в БД.
-	err := e.writeData(tableName, fieldsType, fields)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return tableName, fieldsType, fields, nil
 }
 
-// checkValid проверяет на валидность типы колонок в существующей таблице и в новой записи.
-func (e *ExplorerDB) checkValid(DBFieldsType []message.ColumnsType, recordFieldsType []message.ColumnsType) error {
-	if len(recordFieldsType) != len(DBFieldsType) {
-		return fmt.Errorf("Разное количество полей таблицы в БД и в новой записи.\n")
+// compatibleType проверяет, можно ли записать значение с типом recordType в колонку с типом dbType.
+// Значение можно записать в колонку Nullable того же типа, а null без указанного типа - в любую колонку Nullable.
+// Целое число Int64 можно записать в колонку Float и Decimal.
+func compatibleType(dbType, recordType string) bool {
+	switch {
+	case dbType == recordType:
+		return true
+	case dbType == fmt.Sprintf("Nullable(%s)", recordType):
+		return true
+	case recordType == untypedNullType:
+		return strings.HasPrefix(dbType, "Nullable(")
+	case recordType == "Int64":
+		baseType, _ := unwrapType(dbType, "Nullable")
+		return strings.HasPrefix(baseType, "Float") || strings.HasPrefix(baseType, "Decimal")
 	}
+	return false
+}
 
-	for i := 0; i < len(recordFieldsType); i++ {
-		if recordFieldsType[i].ColType != DBFieldsType[i].ColType {
-			return fmt.Errorf("Несоответсвие типа колонки %s: %s <> %s \n",
-				recordFieldsType[i].ColName,
-				recordFieldsType[i].ColType,
-				DBFieldsType[i].ColType,
-			)
-		}
+// compatibleValue приводит значение совместимого типа к типу колонки dbType: целое число к дробному для колонки Float.
+func compatibleValue(value interface{}, dbType string) interface{} {
+	i, ok := value.(int64)
+	if !ok {
+		return value
 	}
-	return nil
+	if baseType, _ := unwrapType(dbType, "Nullable"); strings.HasPrefix(baseType, "Float") {
+		return float64(i)
+	}
+	return value
 }
 
-// createTable создает таблицу в БД если она не существует.
-func (e *ExplorerDB) createTable(tableName string, fields []message.ColumnsType) error {
+// createTable создает таблицу в БД с указанным движком если она не существует.
+func (e *ExplorerDB) createTable(tableName string, fields []message.ColumnsType, engine TableEngine) error {
 	var queryBuilder strings.Builder
 
 	for _, row := range fields {
-		queryBuilder.WriteString(fmt.Sprintf(" %s %s, ", row.ColName, row.ColType))
+		queryBuilder.WriteString(fmt.Sprintf(" %s %s, ", quoteIdentifier(row.ColName), row.ColType))
 	}
 
-	textQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) engine=Memory",
-		tableName,
-		strings.TrimSuffix(queryBuilder.String(), ", "))
+	textQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) %s",
+		quoteIdentifier(tableName),
+		strings.TrimSuffix(queryBuilder.String(), ", "),
+		engine.engineClause(tableName))
+
+	return e.exec(textQuery)
+}
+
+// storeData записывает подготовленные данные в таблицу с повторными попытками retry.
+// Если БД недоступна или в буфере есть не записанные данные, строки сохраняются в буфер вместе с сообщениями
+// messages, из которых они получены, чтобы сохранить порядок записи. Без буфера возвращается ошибка записи.
+func (e *ExplorerDB) storeData(tableName string, fieldsType []message.ColumnsType, rows [][]message.Pair,
+	messages []*message.Message, retry RetrySettings) error {
+
+	if len(rows) == 0 {
+		return nil
+	}
 
-	_, err := e.connect.Exec(textQuery)
+	// Ключ дедупликации общий для всех попыток, в том числе на других репликах и из буфера:
+	// попытка, завершившаяся ошибкой, могла записать строки.
+	token, err := makeDedupToken()
 	if err != nil {
 		return err
 	}
 
+	entry := spoolEntry{Token: token, Table: tableName, FieldsType: fieldsType, Rows: rows, Messages: messages}
+	if e.spool != nil && e.spool.Pending() {
+		return e.spool.Write(entry)
+	}
+
+	err = retry.do(func() error {
+		return e.writeData(tableName, fieldsType, rows, token)
+	})
+	if err == nil || e.spool == nil || !IsTransient(err) {
+		return err
+	}
+
+	if spoolErr := e.spool.Write(entry); spoolErr != nil {
+		return fmt.Errorf("%w; не удалось сохранить строки в буфер: %s", err, spoolErr)
+	}
+	log.Printf("БД недоступна, %v строк таблицы %s сохранены в буфер: %s", len(rows), tableName, err)
 	return nil
 }
 
-// writeData записывает подготовленные данные в таблицу.
-func (e *ExplorerDB) writeData(tableName string, fieldsType []message.ColumnsType, fields []message.Pair) error {
-	var columnBuilder, valuesBuilder strings.Builder
+// deferRecords сохраняет в буфер записи сообщения msg, схему таблиц для которых не удалось проверить
+// из-за недоступности БД. Без буфера возвращает ошибку err.
+func (e *ExplorerDB) deferRecords(msg *message.Message, records []message.DataRecord, err error) error {
+	if e.spool == nil || !IsTransient(err) {
+		return err
+	}
 
-	for _, row := range fieldsType {
-		columnBuilder.WriteString(fmt.Sprintf(" %s, ", row.ColName))
+	entry := spoolEntry{Records: records}
+	if msg != nil {
+		entry.Messages = []*message.Message{msg}
 	}
+	if spoolErr := e.spool.Write(entry); spoolErr != nil {
+		return fmt.Errorf("%w; не удалось сохранить записи в буфер: %s", err, spoolErr)
+	}
+	log.Printf("БД недоступна, %v записей сохранены в буфер: %s", len(records), err)
+	return nil
+}
 
-	var values []interface{}
-	for _, row := range fields {
-		values = append(values, row.Value)
-		valuesBuilder.WriteString(" ?, ")
+// ReplaySpool записывает в БД данные из буфера в порядке поступления.
+// Строки, которые не удалось записать из-за постоянной ошибки (например, изменилась схема таблицы),
+// пропускаются, чтобы не блокировать запись остальных данных, а их сообщения передаются в onFailure.
+func (e *ExplorerDB) ReplaySpool(onFailure FailureHandler) error {
+	if e.spool == nil || !e.spool.Pending() {
+		return nil
+	}
+
+	replayed, err := e.spool.Replay(func(entry spoolEntry) error {
+		var err error
+		if len(entry.Records) > 0 {
+			err = e.replayRecords(entry)
+		} else {
+			err = e.writeData(entry.Table, entry.FieldsType, entry.Rows, entry.Token)
+		}
+		if err == nil || IsTransient(err) {
+			return err
+		}
+
+		if len(entry.Records) > 0 {
+			err = fmt.Errorf("Не удалось записать из буфера %v записей: %w", len(entry.Records), err)
+		} else {
+			err = fmt.Errorf("Не удалось записать из буфера %v строк в таблицу %s: %w", len(entry.Rows), entry.Table, err)
+		}
+		log.Print(err)
+		if onFailure != nil {
+			onFailure(entry.Messages, err)
+		}
+		return nil
+	})
+	if replayed > 0 {
+		log.Printf("Из буфера в БД записано %v пакетов строк.\n", replayed)
 	}
+	return err
+}
 
-	textQuery := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
-		tableName,
-		strings.TrimSuffix(columnBuilder.String(), ", "),
-		strings.TrimSuffix(valuesBuilder.String(), ", "))
+// replayRecords проверяет схему таблиц для всех записей из буфера, затем записывает каждую отдельным запросом
+// с ключом дедупликации, производным от ключа буфера.
+func (e *ExplorerDB) replayRecords(entry spoolEntry) error {
+	tables := make([]string, len(entry.Records))
+	fieldsTypes := make([][]message.ColumnsType, len(entry.Records))
+	rows := make([][]message.Pair, len(entry.Records))
 
-	_, err := e.connect.Exec(textQuery, values...)
+	for i, data := range entry.Records {
+		var err error
+		tables[i], fieldsTypes[i], rows[i], err = e.prepareRecord(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, tableName := range tables {
+		token := fmt.Sprintf("%s-%v", entry.Token, i)
+		if err := e.writeData(tableName, fieldsTypes[i], [][]message.Pair{rows[i]}, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeData записывает подготовленные данные в таблицу одним запросом INSERT.
+// Если указан token, повторная запись тех же данных с этим ключом не создает дубликатов строк.
+func (e *ExplorerDB) writeData(tableName string, fieldsType []message.ColumnsType, rows [][]message.Pair,
+	token string) error {
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := e.withReplica(func(connect *sql.DB) error {
+		return e.driver.Insert(connect, tableName, fieldsType, rows, token)
+	})
+	metrics.InsertDuration.WithLabelValues(tableName).Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		if code, ok := serverErrorCode(err); ok && staleSchemaCodes[code] {
+			log.Printf("Схема таблицы %s изменилась в БД и будет прочитана повторно.\n", tableName)
+			e.invalidateTable(tableName)
+		}
 		return err
 	}
 
+	metrics.RecordsWritten.WithLabelValues(tableName).Add(float64(len(rows)))
 	return nil
 }
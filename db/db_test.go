@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"mqtt2clickhouse/message"
+	"sync"
+	"testing"
+)
+
+func TestCompatibleType(t *testing.T) {
+	type testVariant struct {
+		dbType     string
+		recordType string
+		result     bool
+	}
+
+	testVariants := []*testVariant{
+		{dbType: "Float64", recordType: "Float64", result: true},
+		{dbType: "Nullable(Float64)", recordType: "Float64", result: true},
+		{dbType: "Nullable(Float64)", recordType: "Nullable(String)", result: true},
+		{dbType: "Float64", recordType: "Nullable(String)", result: false},
+		{dbType: "Float64", recordType: "Int64", result: true},
+		{dbType: "Nullable(Float64)", recordType: "Int64", result: true},
+		{dbType: "Decimal(10, 2)", recordType: "Int64", result: true},
+		{dbType: "Int64", recordType: "Float64", result: false},
+		{dbType: "String", recordType: "Int64", result: false},
+	}
+
+	for i, v := range testVariants {
+		if compatibleType(v.dbType, v.recordType) != v.result {
+			t.Errorf("№%v. Колонка %s, значение %s. Ожидание: %v", i, v.dbType, v.recordType, v.result)
+		}
+	}
+}
+
+// testDriver драйвер, который запоминает запросы INSERT в виде "таблица:строк" и их ключи дедупликации
+// и завершает запросы ошибкой err.
+// Если задан block, запись ожидает его закрытия, а перед ожиданием отправляет сигнал в entered.
+type testDriver struct {
+	err     error
+	block   chan struct{}
+	entered chan struct{}
+	mu      sync.Mutex
+	inserts []string
+	tokens  []string
+}
+
+func (*testDriver) Open(string) (*sql.DB, error) { return &sql.DB{}, nil }
+
+func (d *testDriver) Insert(_ *sql.DB, tableName string, _ []message.ColumnsType, rows [][]message.Pair,
+	token string) error {
+
+	if d.block != nil {
+		d.entered <- struct{}{}
+		<-d.block
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inserts = append(d.inserts, fmt.Sprintf("%s:%v", tableName, len(rows)))
+	d.tokens = append(d.tokens, token)
+	return d.err
+}
+
+// written возвращает выполненные запросы INSERT.
+func (d *testDriver) written() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fmt.Sprint(d.inserts)
+}
+
+func (*testDriver) ErrorCode(error) (int, bool) { return 0, false }
+
+func TestInvalidateTable(t *testing.T) {
+	type testVariant struct {
+		err         error
+		invalidated bool
+	}
+
+	testVariants := []*testVariant{
+		{err: serverError(16), invalidated: true},
+		{err: serverError(60), invalidated: true},
+		{err: serverError(252), invalidated: false},
+		{err: nil, invalidated: false},
+	}
+
+	fieldsType := []message.ColumnsType{{ColName: "value", ColType: "Int64"}}
+	rows := [][]message.Pair{{{Name: "value", Value: int64(1)}}}
+
+	for i, v := range testVariants {
+		e := ExplorerDB{driver: &testDriver{err: v.err}, tablesFromDB: &tablesInfo{"data": nil, "other": nil}}
+		e.replicas.replicas = makeTestReplicas(true)
+
+		_ = e.writeData("data", fieldsType, rows, "")
+
+		_, cached := (*e.tablesFromDB)["data"]
+		if cached == v.invalidated {
+			t.Errorf("№%v. Ошибка %v. Ожидание удаления схемы таблицы: %v", i, v.err, v.invalidated)
+		}
+		if _, ok := (*e.tablesFromDB)["other"]; !ok {
+			t.Errorf("№%v. Схема другой таблицы не должна удаляться", i)
+		}
+	}
+}
+
+func TestReplaySpoolFailure(t *testing.T) {
+	type testVariant struct {
+		err     error
+		failed  string
+		pending bool
+	}
+
+	testVariants := []*testVariant{
+		{err: serverError(16), failed: "[first second]", pending: false},
+		{err: serverError(252), failed: "[]", pending: true},
+		{err: nil, failed: "[]", pending: false},
+	}
+
+	for i, v := range testVariants {
+		spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := makeTestExplorer(&testDriver{err: v.err})
+		e.spool = spool
+
+		entry := makeTestEntry(1)
+		entry.Messages = []*message.Message{{Topic: "first"}, {Topic: "second"}}
+		if err := spool.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+
+		var failed []string
+		_ = e.ReplaySpool(func(messages []*message.Message, err error) {
+			for _, msg := range messages {
+				failed = append(failed, msg.Topic)
+			}
+		})
+
+		if fmt.Sprint(failed) != v.failed {
+			t.Errorf("№%v. Ошибка %v. Отклоненные сообщения. Ожидание: %s, факт: %v", i, v.err, v.failed, failed)
+		}
+		if spool.Pending() != v.pending {
+			t.Errorf("№%v. Ошибка %v. Данные в буфере. Ожидание: %v", i, v.err, v.pending)
+		}
+		spool.Close()
+	}
+}
+
+func TestStoreDataToken(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	d := &testDriver{err: serverError(319)}
+	e := makeTestExplorer(d)
+	e.replicas.replicas = makeTestReplicas(true, true)
+	e.spool = spool
+
+	fieldsType := []message.ColumnsType{{ColName: "value", ColType: "Int64"}}
+	rows := [][]message.Pair{{{Name: "value", Value: int64(1)}}}
+	if err := e.storeData("data", fieldsType, rows, nil, RetrySettings{Attempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = spool.Replay(func(entry spoolEntry) error {
+		d.tokens = append(d.tokens, entry.Token)
+		return nil
+	})
+
+	if len(d.tokens) != 5 {
+		t.Fatalf("Ожидание 4 попыток записи и 1 записи из буфера, факт: %v", d.tokens)
+	}
+	for _, token := range d.tokens {
+		if token == "" || token != d.tokens[0] {
+			t.Errorf("Все попытки записи пакета должны выполняться с одним ключом дедупликации: %v", d.tokens)
+			break
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"mqtt2clickhouse/deadletter"
+	"mqtt2clickhouse/message"
+)
+
+// deadLetterColumns схема таблицы отклоненных сообщений.
+var deadLetterColumns = []message.ColumnsType{
+	{ColName: "topic", ColType: "String"},
+	{ColName: "payload", ColType: "String"},
+	{ColName: "received", ColType: "DateTime64(3)"},
+	{ColName: "reason", ColType: "String"},
+}
+
+// DeadLetterTable записывает отклоненные сообщения в таблицу БД.
+type DeadLetterTable struct {
+	explorer  *ExplorerDB
+	tableName string
+}
+
+// MakeDeadLetterTable создает таблицу для отклоненных сообщений, если ее нет,
+// и возвращает объект для записи в нее.
+// По умолчанию таблица создается с движком MergeTree, настройки движка можно переопределить для этой таблицы.
+func MakeDeadLetterTable(explorer *ExplorerDB, tableName string) (*DeadLetterTable, error) {
+	if tableName == "" {
+		return nil, fmt.Errorf("Не указана таблица для отклоненных сообщений\n")
+	}
+
+	engine := TableEngine{Engine: "MergeTree", OrderBy: "received"}
+	if tableEngine, ok := explorer.engines.Tables[tableName]; ok {
+		engine = tableEngine.merge(engine)
+	}
+
+	err := explorer.createTable(tableName, deadLetterColumns, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetterTable{explorer: explorer, tableName: tableName}, nil
+}
+
+// Send записывает сообщение в таблицу.
+func (d *DeadLetterTable) Send(letter deadletter.Letter) error {
+	row := []message.Pair{
+		{Name: "topic", Value: letter.Topic},
+		{Name: "payload", Value: string(letter.Payload)},
+		{Name: "received", Value: letter.Received},
+		{Name: "reason", Value: letter.Reason},
+	}
+
+	return d.explorer.writeData(d.tableName, deadLetterColumns, [][]message.Pair{row}, "")
+}
+
+// Close ничего не делает, подключением к БД управляет ExplorerDB.
+func (d *DeadLetterTable) Close() error {
+	return nil
+}
@@ -0,0 +1,12 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestMakeDeadLetterTable(t *testing.T) {
+	_, err := MakeDeadLetterTable(&ExplorerDB{}, "")
+	if err == nil {
+		t.Errorf("Без указания таблицы должна возникать ошибка")
+	}
+}
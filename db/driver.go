@@ -0,0 +1,50 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"mqtt2clickhouse/message"
+)
+
+// Драйверы подключения к ClickHouse.
+const (
+	DriverHTTP   = "http"
+	DriverNative = "native"
+)
+
+// Driver описывает драйвер подключения к ClickHouse.
+// Open открывает подключение, Insert записывает строки в таблицу одним запросом INSERT
+// (если указан token, он передается как insert_deduplication_token),
+// ErrorCode возвращает код ошибки ClickHouse, если ошибка получена от сервера.
+type Driver interface {
+	Open(dataSource string) (*sql.DB, error)
+	Insert(connect *sql.DB, tableName string, fieldsType []message.ColumnsType, rows [][]message.Pair,
+		token string) error
+	ErrorCode(err error) (int, bool)
+}
+
+// drivers доступные драйверы по названию.
+var drivers = make(map[string]Driver)
+
+// driverByName возвращает драйвер по названию, пустое название соответствует драйверу http.
+func driverByName(name string) (Driver, error) {
+	if name == "" {
+		name = DriverHTTP
+	}
+
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("Неизвестный драйвер БД %s\n", name)
+	}
+	return d, nil
+}
+
+// serverErrorCode возвращает код ошибки ClickHouse, если ошибка получена от сервера.
+func serverErrorCode(err error) (int, bool) {
+	for _, d := range drivers {
+		if code, ok := d.ErrorCode(err); ok {
+			return code, true
+		}
+	}
+	return 0, false
+}
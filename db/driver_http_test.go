@@ -0,0 +1,51 @@
+package db
+
+import (
+	"database/sql/driver"
+	"github.com/mailru/go-clickhouse/v2"
+	"testing"
+	"time"
+)
+
+// serverError возвращает ошибку ClickHouse с кодом code в формате драйвера http.
+func serverError(code int) error {
+	return &clickhouse.Error{Code: code, Message: "test"}
+}
+
+func TestColumnValue(t *testing.T) {
+	timestamp := time.Date(2021, 11, 24, 20, 27, 23, 123456789, time.UTC)
+
+	type testVariant struct {
+		value   interface{}
+		colType string
+		result  interface{}
+	}
+
+	testVariants := []*testVariant{
+		{value: 27.8, colType: "Float64", result: 27.8},
+		{value: "test", colType: "String", result: "test"},
+		{value: timestamp, colType: "DateTime", result: int64(1637785643)},
+		{value: timestamp, colType: "DateTime64(3)", result: int64(1637785643123)},
+		{value: timestamp, colType: "DateTime64(6, 'UTC')", result: int64(1637785643123456)},
+		{value: timestamp, colType: "DateTime64(0)", result: int64(1637785643)},
+		{value: timestamp, colType: "Nullable(DateTime64(3))", result: int64(1637785643123)},
+		{value: timestamp, colType: "Nullable(DateTime)", result: int64(1637785643)},
+	}
+
+	for i, v := range testVariants {
+		result := columnValue(v.value, v.colType)
+		if result != v.result {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.result, result)
+		}
+	}
+}
+
+func TestColumnValueArray(t *testing.T) {
+	value, err := columnValue([]interface{}{int64(1), 2.5}, "Array(Float64)").(driver.Valuer).Value()
+	if err != nil {
+		t.Fatalf("Ошибка преобразования массива: %s", err)
+	}
+	if string(value.([]byte)) != "[1,2.5]" {
+		t.Errorf("Массив должен передаваться как Array ClickHouse, а передан %s", value)
+	}
+}
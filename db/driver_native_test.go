@@ -0,0 +1,45 @@
+package db
+
+import (
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"reflect"
+	"testing"
+)
+
+// nativeServerError возвращает ошибку ClickHouse с кодом code в формате драйвера native.
+func nativeServerError(code int) error {
+	return &clickhouse.Exception{Code: int32(code), Message: "test"}
+}
+
+func TestNativeValue(t *testing.T) {
+	type testVariant struct {
+		value   interface{}
+		colType string
+		result  interface{}
+	}
+
+	testVariants := []*testVariant{
+		{value: int64(5), colType: "Int64", result: int64(5)},
+		{value: uint64(5), colType: "UInt8", result: uint8(5)},
+		{value: true, colType: "UInt8", result: uint8(1)},
+		{value: int64(3), colType: "Nullable(Float32)", result: float32(3)},
+		{value: "text", colType: "LowCardinality(String)", result: "text"},
+		{value: nil, colType: "Nullable(Int64)", result: nil},
+		{value: []interface{}{int64(1), 2.5}, colType: "Array(Float64)", result: []float64{1, 2.5}},
+		{value: []interface{}{[]interface{}{int64(1)}, []interface{}{}}, colType: "Array(Array(Int32))",
+			result: [][]int32{{1}, {}}},
+		{value: []interface{}{"2021-11-25"}, colType: "Array(Date)", result: []interface{}{"2021-11-25"}},
+	}
+
+	for i, v := range testVariants {
+		result := nativeValue(v.value, v.colType)
+		if !reflect.DeepEqual(result, v.result) {
+			t.Errorf("№%v. Ожидание: %#v, факт: %#v", i, v.result, result)
+		}
+	}
+
+	value := nativeValue([]interface{}{"a", nil}, "Array(Nullable(String))").([]*string)
+	if len(value) != 2 || *value[0] != "a" || value[1] != nil {
+		t.Errorf("Массив с null должен передаваться указателями, а передан %v", value)
+	}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestDriverByName(t *testing.T) {
+	type testVariant struct {
+		name       string
+		dataSource string
+		result     Driver
+		isErr      bool
+	}
+
+	testVariants := []*testVariant{
+		{name: "", dataSource: "http://localhost:8123/default", result: httpDriver{}},
+		{name: DriverHTTP, dataSource: "http://localhost:8123/default", result: httpDriver{}},
+		{name: DriverNative, dataSource: "clickhouse://localhost:9000/default", result: nativeDriver{}},
+		{name: "odbc", isErr: true},
+	}
+
+	for i, v := range testVariants {
+		d, err := driverByName(v.name)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Драйвер '%s'. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.name, v.isErr, err)
+		}
+		if d != v.result {
+			t.Errorf("№%v. Драйвер '%s'. Ожидание: %T, факт: %T", i, v.name, v.result, d)
+		}
+		if d == nil {
+			continue
+		}
+
+		// Оба драйвера доступны в одной сборке.
+		connect, err := d.Open(v.dataSource)
+		if err != nil {
+			t.Errorf("№%v. Драйвер '%s'. Ошибка открытия подключения: %s", i, v.name, err)
+			continue
+		}
+		_ = connect.Close()
+	}
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultEngine = "Memory"
+
+// spoolDeduplicationWindow количество последних вставок, по которым таблица MergeTree отбрасывает повторы,
+// если для записи используется буфер.
+const spoolDeduplicationWindow = 1000
+
+// TableEngine описывает движок и параметры создаваемых таблиц.
+// DeduplicationWindow задает настройку non_replicated_deduplication_window для таблиц MergeTree без репликации.
+type TableEngine struct {
+	Engine              string `json:"engine"`
+	OrderBy             string `json:"orderBy"`
+	PartitionBy         string `json:"partitionBy"`
+	TTL                 string `json:"ttl"`
+	ZooKeeperPath       string `json:"zooKeeperPath"`
+	ReplicaName         string `json:"replicaName"`
+	Version             string `json:"version"`
+	DeduplicationWindow int    `json:"deduplicationWindow"`
+}
+
+// EngineSettings содержит общие настройки движка и настройки для отдельных таблиц.
+type EngineSettings struct {
+	Default TableEngine            `json:"default"`
+	Tables  map[string]TableEngine `json:"tables"`
+}
+
+// merge возвращает настройки движка, в которых пустые поля заполнены из base.
+func (t TableEngine) merge(base TableEngine) TableEngine {
+	if t.Engine == "" {
+		t.Engine = base.Engine
+	}
+	if t.OrderBy == "" {
+		t.OrderBy = base.OrderBy
+	}
+	if t.PartitionBy == "" {
+		t.PartitionBy = base.PartitionBy
+	}
+	if t.TTL == "" {
+		t.TTL = base.TTL
+	}
+	if t.ZooKeeperPath == "" {
+		t.ZooKeeperPath = base.ZooKeeperPath
+	}
+	if t.ReplicaName == "" {
+		t.ReplicaName = base.ReplicaName
+	}
+	if t.Version == "" {
+		t.Version = base.Version
+	}
+	if t.DeduplicationWindow == 0 {
+		t.DeduplicationWindow = base.DeduplicationWindow
+	}
+	return t
+}
+
+// validate проверяет корректность настроек движка.
+func (t TableEngine) validate() error {
+	if t.DeduplicationWindow < 0 {
+		return fmt.Errorf("Некорректный размер окна дедупликации %v\n", t.DeduplicationWindow)
+	}
+
+	switch t.Engine {
+	case "", "Memory":
+		if t.OrderBy != "" || t.PartitionBy != "" || t.TTL != "" || t.DeduplicationWindow != 0 {
+			return fmt.Errorf("Движок Memory не поддерживает ORDER BY, PARTITION BY, TTL и дедупликацию\n")
+		}
+	case "MergeTree", "ReplacingMergeTree":
+	case "ReplicatedMergeTree", "ReplicatedReplacingMergeTree":
+		if t.ZooKeeperPath == "" {
+			return fmt.Errorf("Для движка %s не указан путь в ZooKeeper\n", t.Engine)
+		}
+	default:
+		return fmt.Errorf("Неизвестный движок таблицы %s\n", t.Engine)
+	}
+	return nil
+}
+
+// deduplicates проверяет, отбрасывает ли таблица с этим движком повторную вставку
+// с тем же insert_deduplication_token.
+func (t TableEngine) deduplicates() bool {
+	return t.Engine != "" && t.Engine != "Memory"
+}
+
+// withDeduplication возвращает настройки движка, при которых таблица отбрасывает повторную вставку.
+// Таблицы Replicated*MergeTree отбрасывают повторы по умолчанию, для остальных задается окно дедупликации.
+func (t TableEngine) withDeduplication() TableEngine {
+	if !strings.HasPrefix(t.Engine, "Replicated") && t.DeduplicationWindow == 0 {
+		t.DeduplicationWindow = spoolDeduplicationWindow
+	}
+	return t
+}
+
+// forTable возвращает настройки движка для указанной таблицы.
+func (s EngineSettings) forTable(tableName string) TableEngine {
+	engine, ok := s.Tables[tableName]
+	if !ok {
+		return s.Default
+	}
+	return engine.merge(s.Default)
+}
+
+// validate проверяет общие настройки и настройки каждой таблицы.
+func (s EngineSettings) validate() error {
+	if err := s.Default.validate(); err != nil {
+		return err
+	}
+
+	for tableName := range s.Tables {
+		if err := s.forTable(tableName).validate(); err != nil {
+			return fmt.Errorf("Таблица %s: %s", tableName, err)
+		}
+	}
+	return nil
+}
+
+// validateDeduplication проверяет, что все создаваемые таблицы отбрасывают повторную вставку.
+// Без этого повторная запись из буфера после сбоя создает дубликаты строк.
+func (s EngineSettings) validateDeduplication() error {
+	if !s.Default.deduplicates() {
+		return fmt.Errorf("Движок Memory не поддерживает дедупликацию записи из буфера\n")
+	}
+
+	for tableName := range s.Tables {
+		if !s.forTable(tableName).deduplicates() {
+			return fmt.Errorf("Таблица %s: движок Memory не поддерживает дедупликацию записи из буфера\n", tableName)
+		}
+	}
+	return nil
+}
+
+// engineClause формирует описание движка для запроса CREATE TABLE.
+func (t TableEngine) engineClause(tableName string) string {
+	engine := t.Engine
+	if engine == "" {
+		engine = defaultEngine
+	}
+
+	if engine == "Memory" {
+		return "ENGINE = Memory"
+	}
+
+	var args []string
+	if strings.HasPrefix(engine, "Replicated") {
+		replicaName := t.ReplicaName
+		if replicaName == "" {
+			replicaName = "{replica}"
+		}
+		zooKeeperPath := strings.ReplaceAll(t.ZooKeeperPath, "{table}", tableName)
+		args = append(args, quoteString(zooKeeperPath), quoteString(replicaName))
+	}
+	if strings.HasSuffix(engine, "ReplacingMergeTree") && t.Version != "" {
+		args = append(args, t.Version)
+	}
+
+	var clauseBuilder strings.Builder
+	clauseBuilder.WriteString(fmt.Sprintf("ENGINE = %s(%s)", engine, strings.Join(args, ", ")))
+
+	if t.PartitionBy != "" {
+		clauseBuilder.WriteString(fmt.Sprintf(" PARTITION BY %s", t.PartitionBy))
+	}
+
+	orderBy := t.OrderBy
+	if orderBy == "" {
+		orderBy = "tuple()"
+	}
+	clauseBuilder.WriteString(fmt.Sprintf(" ORDER BY %s", orderBy))
+
+	if t.TTL != "" {
+		clauseBuilder.WriteString(fmt.Sprintf(" TTL %s", t.TTL))
+	}
+
+	if t.DeduplicationWindow > 0 && !strings.HasPrefix(engine, "Replicated") {
+		clauseBuilder.WriteString(fmt.Sprintf(" SETTINGS non_replicated_deduplication_window = %v",
+			t.DeduplicationWindow))
+	}
+
+	return clauseBuilder.String()
+}
+
+// quoteIdentifier экранирует название таблицы или колонки для использования в запросе.
+func quoteIdentifier(name string) string {
+	name = strings.ReplaceAll(name, `\`, `\\`)
+	name = strings.ReplaceAll(name, "`", "\\`")
+	return "`" + name + "`"
+}
+
+// quoteString экранирует строку для использования в запросе.
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestEngineClause(t *testing.T) {
+	type testVariant struct {
+		engine TableEngine
+		result string
+	}
+
+	testVariants := []*testVariant{
+		{engine: TableEngine{}, result: "ENGINE = Memory"},
+		{engine: TableEngine{Engine: "MergeTree"}, result: "ENGINE = MergeTree() ORDER BY tuple()"},
+		{
+			engine: TableEngine{
+				Engine:      "MergeTree",
+				OrderBy:     "(device, timestamp)",
+				PartitionBy: "toYYYYMM(timestamp)",
+				TTL:         "timestamp + INTERVAL 1 MONTH",
+			},
+			result: "ENGINE = MergeTree() PARTITION BY toYYYYMM(timestamp) ORDER BY (device, timestamp) " +
+				"TTL timestamp + INTERVAL 1 MONTH",
+		},
+		{
+			engine: TableEngine{Engine: "ReplacingMergeTree", Version: "timestamp", OrderBy: "device"},
+			result: "ENGINE = ReplacingMergeTree(timestamp) ORDER BY device",
+		},
+		{
+			engine: TableEngine{Engine: "ReplicatedMergeTree", ZooKeeperPath: "/clickhouse/tables/{shard}/{table}"},
+			result: "ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/temp_out', '{replica}') ORDER BY tuple()",
+		},
+		{
+			engine: TableEngine{Engine: "MergeTree", DeduplicationWindow: 100},
+			result: "ENGINE = MergeTree() ORDER BY tuple() SETTINGS non_replicated_deduplication_window = 100",
+		},
+	}
+
+	for i, v := range testVariants {
+		clause := v.engine.engineClause("temp_out")
+		if clause != v.result {
+			t.Errorf("№%v. Ожидание: %s, факт: %s", i, v.result, clause)
+		}
+	}
+}
+
+func TestEngineSettingsForTable(t *testing.T) {
+	settings := EngineSettings{
+		Default: TableEngine{Engine: "MergeTree", OrderBy: "device", PartitionBy: "toYYYYMM(timestamp)"},
+		Tables: map[string]TableEngine{
+			"temp_out": {OrderBy: "(device, timestamp)"},
+		},
+	}
+
+	engine := settings.forTable("temp_out")
+	expected := TableEngine{Engine: "MergeTree", OrderBy: "(device, timestamp)", PartitionBy: "toYYYYMM(timestamp)"}
+	if engine != expected {
+		t.Errorf("Настройки таблицы должны дополняться общими настройками: %v != %v", engine, expected)
+	}
+
+	engine = settings.forTable("hum_out")
+	if engine != settings.Default {
+		t.Errorf("Для таблицы без настроек должны использоваться общие настройки: %v", engine)
+	}
+}
+
+func TestEngineSettingsValidate(t *testing.T) {
+	type testVariant struct {
+		settings EngineSettings
+		isErr    bool
+	}
+
+	testVariants := []*testVariant{
+		{settings: EngineSettings{}, isErr: false},
+		{settings: EngineSettings{Default: TableEngine{Engine: "MergeTree"}}, isErr: false},
+		{settings: EngineSettings{Default: TableEngine{Engine: "Log"}}, isErr: true},
+		{settings: EngineSettings{Default: TableEngine{OrderBy: "device"}}, isErr: true},
+		{settings: EngineSettings{Default: TableEngine{Engine: "ReplicatedMergeTree"}}, isErr: true},
+		{settings: EngineSettings{Default: TableEngine{DeduplicationWindow: 100}}, isErr: true},
+		{settings: EngineSettings{Default: TableEngine{Engine: "MergeTree", DeduplicationWindow: -1}}, isErr: true},
+		{
+			settings: EngineSettings{
+				Default: TableEngine{Engine: "MergeTree"},
+				Tables:  map[string]TableEngine{"temp_out": {Engine: "Unknown"}},
+			},
+			isErr: true,
+		},
+	}
+
+	for i, v := range testVariants {
+		err := v.settings.validate()
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+		}
+	}
+}
+
+func TestEngineSettingsValidateDeduplication(t *testing.T) {
+	type testVariant struct {
+		settings EngineSettings
+		isErr    bool
+	}
+
+	testVariants := []*testVariant{
+		{settings: EngineSettings{}, isErr: true},
+		{settings: EngineSettings{Default: TableEngine{Engine: "MergeTree"}}, isErr: false},
+		{
+			settings: EngineSettings{
+				Default: TableEngine{Engine: "MergeTree"},
+				Tables:  map[string]TableEngine{"temp_out": {Engine: "Memory"}},
+			},
+			isErr: true,
+		},
+	}
+
+	for i, v := range testVariants {
+		err := v.settings.validateDeduplication()
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+		}
+	}
+}
+
+func TestEngineWithDeduplication(t *testing.T) {
+	type testVariant struct {
+		engine TableEngine
+		window int
+	}
+
+	testVariants := []*testVariant{
+		{engine: TableEngine{Engine: "MergeTree"}, window: spoolDeduplicationWindow},
+		{engine: TableEngine{Engine: "ReplacingMergeTree", DeduplicationWindow: 10}, window: 10},
+		{engine: TableEngine{Engine: "ReplicatedMergeTree", ZooKeeperPath: "/clickhouse/{table}"}, window: 0},
+	}
+
+	for i, v := range testVariants {
+		engine := v.engine.withDeduplication()
+		if engine.DeduplicationWindow != v.window {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.window, engine.DeduplicationWindow)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Стратегии выбора реплики БД для запросов.
+const (
+	BalanceFirstHealthy = "first-healthy"
+	BalanceRoundRobin   = "round-robin"
+)
+
+// replica подключение к реплике БД и признак ее доступности по результату последнего запроса или проверки.
+type replica struct {
+	dataSource string
+	connect    *sql.DB
+	healthy    bool
+}
+
+// replicaSet реплики БД и стратегия выбора реплики для запросов.
+type replicaSet struct {
+	replicas []*replica
+	balance  string
+	next     int
+	mu       sync.Mutex
+}
+
+// validateBalance проверяет название стратегии выбора реплики.
+func validateBalance(balance string) error {
+	switch balance {
+	case "", BalanceFirstHealthy, BalanceRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("Стратегия выбора реплики должна быть %s или %s, указано '%s'\n",
+		BalanceFirstHealthy, BalanceRoundRobin, balance)
+}
+
+// all возвращает все реплики.
+func (r *replicaSet) all() []*replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*replica(nil), r.replicas...)
+}
+
+// order возвращает реплики в порядке попыток выполнения запроса: сначала доступные реплики
+// в порядке стратегии (первая доступная или по кругу), затем недоступные.
+func (r *replicaSet) order() []*replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.replicas)
+	start := 0
+	if r.balance == BalanceRoundRobin && n > 0 {
+		start = r.next % n
+		r.next = (r.next + 1) % n
+	}
+
+	healthy := make([]*replica, 0, n)
+	var unhealthy []*replica
+	for i := 0; i < n; i++ {
+		rep := r.replicas[(start+i)%n]
+		if rep.healthy {
+			healthy = append(healthy, rep)
+		} else {
+			unhealthy = append(unhealthy, rep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// setHealthy обновляет признак доступности реплики.
+func (r *replicaSet) setHealthy(rep *replica, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rep.healthy != healthy {
+		if healthy {
+			log.Printf("Реплика БД %s снова доступна.\n", rep.dataSource)
+		} else {
+			log.Printf("Реплика БД %s недоступна.\n", rep.dataSource)
+		}
+	}
+	rep.healthy = healthy
+}
+
+// withReplica выполняет action на реплике, выбранной стратегией.
+// Если запрос завершился временной ошибкой, реплика помечается недоступной и запрос выполняется
+// на следующей реплике. Возвращает ошибку последней попытки.
+func (e *ExplorerDB) withReplica(action func(connect *sql.DB) error) error {
+	replicas := e.replicas.order()
+	if len(replicas) == 0 {
+		return fmt.Errorf("Нет подключения к БД\n")
+	}
+
+	var err error
+	for i, rep := range replicas {
+		err = action(rep.connect)
+		if err == nil {
+			e.replicas.setHealthy(rep, true)
+			return nil
+		}
+		if !IsTransient(err) {
+			return err
+		}
+
+		e.replicas.setHealthy(rep, false)
+		if i < len(replicas)-1 {
+			log.Printf("Ошибка запроса к реплике БД %s, запрос будет выполнен на другой реплике: %s",
+				rep.dataSource, err)
+		}
+	}
+	return err
+}
+
+// exec выполняет запрос без результата на реплике, выбранной стратегией.
+func (e *ExplorerDB) exec(query string) error {
+	return e.withReplica(func(connect *sql.DB) error {
+		_, err := connect.Exec(query)
+		return err
+	})
+}
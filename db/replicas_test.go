@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+)
+
+// makeTestReplicas возвращает реплики с признаками доступности healthy.
+func makeTestReplicas(healthy ...bool) []*replica {
+	replicas := make([]*replica, len(healthy))
+	for i, h := range healthy {
+		replicas[i] = &replica{dataSource: fmt.Sprintf("replica%v", i), connect: &sql.DB{}, healthy: h}
+	}
+	return replicas
+}
+
+// replicaNames возвращает адреса реплик.
+func replicaNames(replicas []*replica) string {
+	var names string
+	for _, rep := range replicas {
+		names += rep.dataSource + " "
+	}
+	return names
+}
+
+func TestReplicaOrder(t *testing.T) {
+	first := replicaSet{replicas: makeTestReplicas(false, true, true)}
+	for i := 0; i < 2; i++ {
+		if names := replicaNames(first.order()); names != "replica1 replica2 replica0 " {
+			t.Errorf("Стратегия first-healthy. Факт: %s", names)
+		}
+	}
+
+	roundRobin := replicaSet{replicas: makeTestReplicas(true, false, true), balance: BalanceRoundRobin}
+	expected := []string{
+		"replica0 replica2 replica1 ",
+		"replica2 replica0 replica1 ",
+		"replica2 replica0 replica1 ",
+		"replica0 replica2 replica1 ",
+	}
+	for i, v := range expected {
+		if names := replicaNames(roundRobin.order()); names != v {
+			t.Errorf("Стратегия round-robin, запрос %v. Ожидание: %s, факт: %s", i, v, names)
+		}
+	}
+}
+
+func TestWithReplica(t *testing.T) {
+	e := ExplorerDB{}
+	e.replicas.replicas = makeTestReplicas(true, true)
+	failed := e.replicas.replicas[0].connect
+
+	var used []*sql.DB
+	err := e.withReplica(func(connect *sql.DB) error {
+		used = append(used, connect)
+		if connect == failed {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil || len(used) != 2 {
+		t.Fatalf("Запрос должен быть выполнен на второй реплике: %v попыток, ошибка %v", len(used), err)
+	}
+	if e.replicas.replicas[0].healthy || !e.replicas.replicas[1].healthy {
+		t.Errorf("Реплика с временной ошибкой должна быть помечена недоступной")
+	}
+
+	used = nil
+	err = e.withReplica(func(connect *sql.DB) error {
+		used = append(used, connect)
+		return fmt.Errorf("Синтаксическая ошибка")
+	})
+	if err == nil || len(used) != 1 || used[0] != e.replicas.replicas[1].connect {
+		t.Errorf("Постоянная ошибка не должна повторяться на другой реплике: %v попыток, ошибка %v", len(used), err)
+	}
+
+	used = nil
+	err = e.withReplica(func(connect *sql.DB) error {
+		used = append(used, connect)
+		return driver.ErrBadConn
+	})
+	if err != driver.ErrBadConn || len(used) != 2 {
+		t.Errorf("Запрос должен быть выполнен на всех репликах: %v попыток, ошибка %v", len(used), err)
+	}
+
+	if err := (&ExplorerDB{}).withReplica(func(*sql.DB) error { return nil }); err == nil {
+		t.Errorf("Без подключения к БД должна возникать ошибка")
+	}
+}
+
+func TestValidateBalance(t *testing.T) {
+	for _, balance := range []string{"", BalanceFirstHealthy, BalanceRoundRobin} {
+		if err := validateBalance(balance); err != nil {
+			t.Errorf("Стратегия %s: %s", balance, err)
+		}
+	}
+	if err := validateBalance("random"); err == nil {
+		t.Errorf("Для неизвестной стратегии должна возникать ошибка")
+	}
+}
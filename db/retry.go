@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// transientCodes коды ошибок ClickHouse, после которых запрос можно повторить.
+var transientCodes = map[int]bool{
+	159: true, // TIMEOUT_EXCEEDED
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	203: true, // NO_FREE_CONNECTION
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	285: true, // TOO_FEW_LIVE_REPLICAS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	999: true, // KEEPER_EXCEPTION
+}
+
+// RetrySettings описывает повторные попытки выполнения запроса при временных ошибках БД.
+type RetrySettings struct {
+	Attempts int
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// IsTransient проверяет, является ли ошибка БД временной, то есть может ли повторный запрос завершиться успешно.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	if code, ok := serverErrorCode(err); ok {
+		return transientCodes[code]
+	}
+
+	return false
+}
+
+// do выполняет action и повторяет его с увеличивающейся задержкой, пока ошибка временная.
+func (r RetrySettings) do(action func() error) error {
+	delay := r.MinDelay
+
+	for attempt := 1; ; attempt++ {
+		err := action()
+		if err == nil || !IsTransient(err) || attempt >= r.Attempts {
+			return err
+		}
+
+		log.Printf("Временная ошибка БД (попытка %v из %v), повтор через %s: %s",
+			attempt, r.Attempts, delay, err)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	type testVariant struct {
+		err    error
+		result bool
+	}
+
+	testVariants := []*testVariant{
+		{err: nil, result: false},
+		{err: driver.ErrBadConn, result: true},
+		{err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, result: true},
+		{err: serverError(252), result: true},
+		{err: fmt.Errorf("wrapped: %w", serverError(209)), result: true},
+		{err: serverError(62), result: false},
+		{err: nativeServerError(252), result: true},
+		{err: nativeServerError(62), result: false},
+		{err: fmt.Errorf("Несоответсвие типа колонки"), result: false},
+	}
+
+	for i, v := range testVariants {
+		result := IsTransient(v.err)
+		if result != v.result {
+			t.Errorf("№%v. Ошибка %v. Ожидание: %v, факт: %v", i, v.err, v.result, result)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	retry := RetrySettings{Attempts: 3}
+
+	type testVariant struct {
+		err      error
+		attempts int
+	}
+
+	testVariants := []*testVariant{
+		{err: nil, attempts: 1},
+		{err: driver.ErrBadConn, attempts: 3},
+		{err: fmt.Errorf("Разное количество полей"), attempts: 1},
+	}
+
+	for i, v := range testVariants {
+		attempts := 0
+		err := retry.do(func() error {
+			attempts++
+			return v.err
+		})
+
+		if err != v.err {
+			t.Errorf("№%v. Должна возвращаться последняя ошибка: %v != %v", i, err, v.err)
+		}
+		if attempts != v.attempts {
+			t.Errorf("№%v. Количество попыток. Ожидание: %v, факт: %v", i, v.attempts, attempts)
+		}
+	}
+}
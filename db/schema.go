@@ -0,0 +1,261 @@
+package db
+
+import (
+	"fmt"
+	"mqtt2clickhouse/message"
+	"mqtt2clickhouse/metrics"
+	"regexp"
+	"strings"
+)
+
+// Политики обработки несовпадения типа поля записи и колонки таблицы.
+const (
+	ConflictReject = "reject"
+	ConflictWiden  = "widen"
+	ConflictSide   = "side"
+)
+
+// Политики обработки полей записи, для которых нет колонки в таблице.
+const (
+	UnknownError = "error"
+	UnknownDrop  = "drop"
+)
+
+// sideNameRe описывает символы типа, которые заменяются в названии дополнительной колонки.
+var sideNameRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// SchemaSettings описывает сопоставление записей с колонками существующих таблиц.
+// Coercion - режим приведения значений к типу колонки: strict - без приведения, lenient - без потери данных,
+// best-effort - с возможной потерей точности, при неудаче в колонку Nullable записывается null.
+// Evolve - добавлять в таблицу колонки для новых полей записи,
+// Conflict - политика при несовпадении типов, если Evolve включен: reject - отклонить запись, widen - расширить
+// тип колонки (Int64 до Float64), side - записать значение в дополнительную колонку с названием вида value_string,
+// UnknownFields - политика для полей, которых нет в таблице, если Evolve выключен: error - отклонить запись,
+// drop - не записывать поле.
+type SchemaSettings struct {
+	Evolve        bool   `json:"evolve"`
+	Conflict      string `json:"conflict"`
+	UnknownFields string `json:"unknownFields"`
+	Coercion      string `json:"coercion"`
+}
+
+// schemaChange описывает добавление колонки или изменение ее типа.
+type schemaChange struct {
+	column message.ColumnsType
+	modify bool
+}
+
+// validate проверяет корректность настроек изменения схемы.
+func (s SchemaSettings) validate() error {
+	switch s.Conflict {
+	case "", ConflictReject, ConflictWiden, ConflictSide:
+	default:
+		return fmt.Errorf("Неизвестная политика несовпадения типов %s\n", s.Conflict)
+	}
+
+	switch s.UnknownFields {
+	case "", UnknownError, UnknownDrop:
+	default:
+		return fmt.Errorf("Неизвестная политика для отсутствующих в таблице полей %s\n", s.UnknownFields)
+	}
+
+	switch s.Coercion {
+	case "", CoercionStrict, CoercionLenient, CoercionBestEffort:
+	default:
+		return fmt.Errorf("Неизвестный режим приведения типов %s\n", s.Coercion)
+	}
+	return nil
+}
+
+// query формирует запрос ALTER TABLE для изменения схемы.
+func (c schemaChange) query(tableName string) string {
+	action := "ADD COLUMN IF NOT EXISTS"
+	if c.modify {
+		action = "MODIFY COLUMN"
+	}
+	return fmt.Sprintf("ALTER TABLE %s %s %s %s",
+		quoteIdentifier(tableName), action, quoteIdentifier(c.column.ColName), c.column.ColType)
+}
+
+// match сопоставляет поля записи с колонками таблицы по названию и возвращает описание и значения полей
+// для записи, а также изменения схемы, которые нужно выполнить перед записью.
+// Колонки таблицы, которых нет в записи, заполняются выражениями DEFAULT и MATERIALIZED
+// или значениями по умолчанию для типа колонки.
+func (s SchemaSettings) match(tableName string, DBFieldsType []columnInfo, recordFieldsType []message.ColumnsType,
+	fields []message.Pair) ([]message.ColumnsType, []message.Pair, []schemaChange, error) {
+
+	if len(recordFieldsType) != len(fields) {
+		return nil, nil, nil, fmt.Errorf("Разное количество полей и их описаний в записи.\n")
+	}
+
+	columns := make(map[string]columnInfo, len(DBFieldsType))
+	for _, column := range DBFieldsType {
+		columns[column.ColName] = column
+	}
+
+	resultTypes := make([]message.ColumnsType, 0, len(recordFieldsType))
+	resultFields := make([]message.Pair, 0, len(fields))
+	var changes []schemaChange
+
+	for i, column := range recordFieldsType {
+		field := fields[i]
+
+		dbColumn, ok := columns[column.ColName]
+		switch {
+		case ok && !dbColumn.insertable():
+			if s.UnknownFields == UnknownDrop {
+				continue
+			}
+			return nil, nil, nil, fmt.Errorf("Колонка %s вычисляется в БД (%s) и не может быть записана.\n",
+				column.ColName, dbColumn.defaultKind)
+
+		case !ok && !s.Evolve:
+			if s.UnknownFields == UnknownDrop {
+				continue
+			}
+			return nil, nil, nil, fmt.Errorf("Колонка %s отсутствует в таблице.\n", column.ColName)
+
+		case !ok:
+			changes = append(changes, schemaChange{column: column})
+			columns[column.ColName] = columnInfo{ColumnsType: column}
+
+		case compatibleType(dbColumn.ColType, column.ColType):
+			field.Value = compatibleValue(field.Value, dbColumn.ColType)
+			column.ColType = dbColumn.ColType
+
+		case s.coerceField(tableName, &field, column.ColType, dbColumn.ColType):
+			column.ColType = dbColumn.ColType
+
+		case s.Evolve && s.Conflict == ConflictWiden:
+			widenedType, value, modify, err := widen(dbColumn.ColType, column.ColType, field.Value)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("Колонка %s: %s", column.ColName, err)
+			}
+			if modify {
+				changes = append(changes, schemaChange{column: message.ColumnsType{
+					ColName: column.ColName, ColType: widenedType}, modify: true})
+				dbColumn.ColType = widenedType
+				columns[column.ColName] = dbColumn
+			}
+			column.ColType = widenedType
+			field.Value = value
+
+		case s.Evolve && s.Conflict == ConflictSide:
+			column.ColName = sideColumnName(column.ColName, column.ColType)
+			field.Name = column.ColName
+
+			sideColumn, ok := columns[column.ColName]
+			if !ok {
+				changes = append(changes, schemaChange{column: column})
+				columns[column.ColName] = columnInfo{ColumnsType: column}
+			} else if !sideColumn.insertable() || !compatibleType(sideColumn.ColType, column.ColType) {
+				return nil, nil, nil, fmt.Errorf("Несоответсвие типа колонки %s: %s <> %s \n",
+					column.ColName, column.ColType, sideColumn.ColType)
+			} else {
+				column.ColType = sideColumn.ColType
+			}
+
+		default:
+			return nil, nil, nil, fmt.Errorf("Несоответсвие типа колонки %s: %s <> %s \n",
+				column.ColName, column.ColType, dbColumn.ColType)
+		}
+
+		resultTypes = append(resultTypes, column)
+		resultFields = append(resultFields, field)
+	}
+
+	if len(resultTypes) == 0 {
+		return nil, nil, nil, fmt.Errorf("В записи нет полей, которые можно записать в таблицу.\n")
+	}
+	if err := checkColumnNames(resultTypes); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return resultTypes, resultFields, changes, nil
+}
+
+// coerceField приводит значение поля к типу колонки dbType и учитывает результат в метриках.
+// Возвращает false, если значение привести не удалось.
+func (s SchemaSettings) coerceField(tableName string, field *message.Pair, recordType, dbType string) bool {
+	if s.Coercion == "" || s.Coercion == CoercionStrict {
+		return false
+	}
+
+	value, err := coerce(field.Value, dbType, s.Coercion)
+	if err != nil {
+		metrics.CoercionFailures.WithLabelValues(tableName, recordType, dbType).Inc()
+		if _, nullable := unwrapType(dbType, "Nullable"); s.Coercion == CoercionBestEffort && nullable {
+			field.Value = nil
+			return true
+		}
+		return false
+	}
+
+	metrics.Coercions.WithLabelValues(tableName, recordType, dbType).Inc()
+	field.Value = value
+	return true
+}
+
+// widen возвращает общий тип для колонки с типом dbType и значения с типом recordType.
+// Если общий тип шире типа колонки, то колонку нужно изменить (modify).
+func widen(dbType, recordType string, value interface{}) (string, interface{}, bool, error) {
+	baseType, nullable := unwrapType(dbType, "Nullable")
+
+	switch {
+	case baseType == "Float64" && recordType == "Int64":
+		if i, ok := value.(int64); ok {
+			value = float64(i)
+		}
+		return dbType, value, false, nil
+	case baseType == "Int64" && recordType == "Float64":
+		widenedType := "Float64"
+		if nullable {
+			widenedType = "Nullable(Float64)"
+		}
+		return widenedType, value, true, nil
+	}
+
+	return "", nil, false, fmt.Errorf("Тип %s нельзя расширить до %s\n", dbType, recordType)
+}
+
+// sideColumnName возвращает название дополнительной колонки для значения с типом colType.
+func sideColumnName(name, colType string) string {
+	suffix := strings.Trim(sideNameRe.ReplaceAllString(strings.ToLower(colType), "_"), "_")
+	return fmt.Sprintf("%s_%s", name, suffix)
+}
+
+// checkColumnNames проверяет, что названия колонок записи не повторяются.
+func checkColumnNames(fieldsType []message.ColumnsType) error {
+	names := make(map[string]bool, len(fieldsType))
+	for _, column := range fieldsType {
+		if names[column.ColName] {
+			return fmt.Errorf("Колонка %s встречается в записи несколько раз.\n", column.ColName)
+		}
+		names[column.ColName] = true
+	}
+	return nil
+}
+
+// applySchemaChanges выполняет изменения схемы таблицы и обновляет сохраненную схему.
+func (e *ExplorerDB) applySchemaChanges(tableName string, changes []schemaChange) error {
+	for _, change := range changes {
+		if err := e.exec(change.query(tableName)); err != nil {
+			return fmt.Errorf("Не удалось изменить схему таблицы %s: %w", tableName, err)
+		}
+
+		e.mu.Lock()
+		columns := append([]columnInfo(nil), (*e.tablesFromDB)[tableName]...)
+		if change.modify {
+			for i := range columns {
+				if columns[i].ColName == change.column.ColName {
+					columns[i].ColType = change.column.ColType
+				}
+			}
+		} else {
+			columns = append(columns, columnInfo{ColumnsType: change.column})
+		}
+		(*e.tablesFromDB)[tableName] = columns
+		e.mu.Unlock()
+	}
+	return nil
+}
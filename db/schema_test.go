@@ -0,0 +1,144 @@
+package db
+
+import (
+	"mqtt2clickhouse/message"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaMatch(t *testing.T) {
+	dbFieldsType := []columnInfo{
+		{ColumnsType: message.ColumnsType{ColName: "client", ColType: "String"}},
+		{ColumnsType: message.ColumnsType{ColName: "value", ColType: "Int64"}},
+		{ColumnsType: message.ColumnsType{ColName: "status", ColType: "String"}, defaultKind: "DEFAULT"},
+		{ColumnsType: message.ColumnsType{ColName: "day", ColType: "Date"}, defaultKind: defaultMaterialized},
+		{ColumnsType: message.ColumnsType{ColName: "timestamp", ColType: "DateTime64(3)"}},
+	}
+
+	type testVariant struct {
+		settings   SchemaSettings
+		fieldsType []message.ColumnsType
+		fields     []message.Pair
+		resultType []message.ColumnsType
+		result     []message.Pair
+		changes    []schemaChange
+		isErr      bool
+	}
+
+	testVariants := []*testVariant{
+		{
+			settings: SchemaSettings{Evolve: true},
+			fieldsType: []message.ColumnsType{
+				{ColName: "value", ColType: "Int64"},
+				{ColName: "client", ColType: "String"},
+				{ColName: "rssi", ColType: "Int64"},
+			},
+			fields: []message.Pair{
+				{Name: "value", Value: int64(1)},
+				{Name: "client", Value: "a"},
+				{Name: "rssi", Value: int64(-60)},
+			},
+			resultType: []message.ColumnsType{
+				{ColName: "value", ColType: "Int64"},
+				{ColName: "client", ColType: "String"},
+				{ColName: "rssi", ColType: "Int64"},
+			},
+			result: []message.Pair{
+				{Name: "value", Value: int64(1)},
+				{Name: "client", Value: "a"},
+				{Name: "rssi", Value: int64(-60)},
+			},
+			changes: []schemaChange{{column: message.ColumnsType{ColName: "rssi", ColType: "Int64"}}},
+		},
+		{
+			settings:   SchemaSettings{Evolve: true},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "Float64"}},
+			fields:     []message.Pair{{Name: "value", Value: 1.5}},
+			isErr:      true,
+		},
+		{
+			settings:   SchemaSettings{Evolve: true, Conflict: ConflictWiden},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "Float64"}},
+			fields:     []message.Pair{{Name: "value", Value: 1.5}},
+			resultType: []message.ColumnsType{{ColName: "value", ColType: "Float64"}},
+			result:     []message.Pair{{Name: "value", Value: 1.5}},
+			changes:    []schemaChange{{column: message.ColumnsType{ColName: "value", ColType: "Float64"}, modify: true}},
+		},
+		{
+			settings:   SchemaSettings{Evolve: true, Conflict: ConflictWiden},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "String"}},
+			fields:     []message.Pair{{Name: "value", Value: "high"}},
+			isErr:      true,
+		},
+		{
+			settings:   SchemaSettings{Coercion: CoercionLenient},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "String"}},
+			fields:     []message.Pair{{Name: "value", Value: "12"}},
+			resultType: []message.ColumnsType{{ColName: "value", ColType: "Int64"}},
+			result:     []message.Pair{{Name: "value", Value: int64(12)}},
+		},
+		{
+			settings:   SchemaSettings{Coercion: CoercionLenient},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "String"}},
+			fields:     []message.Pair{{Name: "value", Value: "high"}},
+			isErr:      true,
+		},
+		{
+			settings:   SchemaSettings{Evolve: true, Conflict: ConflictSide},
+			fieldsType: []message.ColumnsType{{ColName: "value", ColType: "String"}},
+			fields:     []message.Pair{{Name: "value", Value: "high"}},
+			resultType: []message.ColumnsType{{ColName: "value_string", ColType: "String"}},
+			result:     []message.Pair{{Name: "value_string", Value: "high"}},
+			changes:    []schemaChange{{column: message.ColumnsType{ColName: "value_string", ColType: "String"}}},
+		},
+	}
+
+	for i, v := range testVariants {
+		resultType, result, changes, err := v.settings.match("temp_out", dbFieldsType, v.fieldsType, v.fields)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(resultType, v.resultType) || !reflect.DeepEqual(result, v.result) {
+			t.Errorf("№%v. Поля записи. Ожидание: %v %v, факт: %v %v", i, v.resultType, v.result, resultType, result)
+		}
+		if !reflect.DeepEqual(changes, v.changes) {
+			t.Errorf("№%v. Изменения схемы. Ожидание: %v, факт: %v", i, v.changes, changes)
+		}
+	}
+}
+
+func TestWidenInt64Value(t *testing.T) {
+	colType, value, modify, err := widen("Nullable(Float64)", "Int64", int64(2))
+	if err != nil || modify || colType != "Nullable(Float64)" || value != 2.0 {
+		t.Errorf("Целое значение должно записываться в колонку Float64: %v %v %v %v", colType, value, modify, err)
+	}
+}
+
+func TestSchemaChangeQuery(t *testing.T) {
+	change := schemaChange{column: message.ColumnsType{ColName: "rssi", ColType: "Int64"}}
+	expected := "ALTER TABLE `temp_out` ADD COLUMN IF NOT EXISTS `rssi` Int64"
+	if query := change.query("temp_out"); query != expected {
+		t.Errorf("Ожидание: %s, факт: %s", expected, query)
+	}
+
+	change.modify = true
+	expected = "ALTER TABLE `temp_out` MODIFY COLUMN `rssi` Int64"
+	if query := change.query("temp_out"); query != expected {
+		t.Errorf("Ожидание: %s, факт: %s", expected, query)
+	}
+}
+
+func TestSchemaMatchIntegralValue(t *testing.T) {
+	dbFieldsType := []columnInfo{{ColumnsType: message.ColumnsType{ColName: "value", ColType: "Nullable(Float64)"}}}
+	settings := SchemaSettings{Coercion: CoercionStrict, UnknownFields: UnknownError}
+
+	resultType, result, _, err := settings.match("temp", dbFieldsType,
+		[]message.ColumnsType{{ColName: "value", ColType: "Int64"}}, []message.Pair{{Name: "value", Value: int64(21)}})
+	if err != nil {
+		t.Fatalf("Целое число должно записываться в колонку Float64: %s", err)
+	}
+	if resultType[0].ColType != "Nullable(Float64)" || result[0].Value != 21.0 {
+		t.Errorf("Ожидание: Nullable(Float64) 21, факт: %s %v (%T)", resultType[0].ColType, result[0].Value, result[0].Value)
+	}
+}
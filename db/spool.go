@@ -0,0 +1,391 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"mqtt2clickhouse/message"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Размеры буфера записей по умолчанию.
+const (
+	defaultSpoolMaxBytes     = 1 << 30
+	defaultSpoolSegmentBytes = 64 << 20
+)
+
+const (
+	spoolSegmentExt     = ".spool"
+	spoolCheckpointFile = "checkpoint.json"
+	// spoolHeaderSize размер заголовка записи в файле буфера: длина и контрольная сумма данных.
+	spoolHeaderSize = 8
+)
+
+func init() {
+	// Типы значений полей записи, которые передаются в gob как interface{}.
+	gob.Register(time.Time{})
+	gob.Register([]interface{}{})
+	// Значения полей записи message.DataRecord.
+	gob.Register([]message.ColumnsType{})
+	gob.Register([]message.Pair{})
+}
+
+// SpoolSettings описывает локальный буфер записей на время недоступности БД.
+// Dir - каталог файлов буфера (если не указан, буфер выключен), MaxBytes - максимальный размер буфера,
+// SegmentBytes - максимальный размер одного файла буфера.
+type SpoolSettings struct {
+	Dir          string
+	MaxBytes     int64
+	SegmentBytes int64
+}
+
+// spoolEntry строки одной таблицы, сохраненные в буфер.
+// Token - ключ дедупликации INSERT, с которым строки записываются в БД при каждой попытке.
+// Messages - сообщения, из которых получены строки, чтобы отклонить их, если строки не удастся записать.
+// Records - записи, схему таблиц для которых не удалось проверить, они проверяются при записи из буфера.
+type spoolEntry struct {
+	Token      string
+	Table      string
+	FieldsType []message.ColumnsType
+	Rows       [][]message.Pair
+	Messages   []*message.Message
+	Records    []message.DataRecord
+}
+
+// spoolPosition позиция в буфере, до которой записи уже записаны в БД.
+type spoolPosition struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Spool локальный буфер записей, которые не удалось записать в БД, в файлах-сегментах каталога.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu          sync.Mutex
+	segments    []int64
+	size        int64
+	current     *os.File
+	currentSize int64
+	checkpoint  spoolPosition
+
+	replayMu sync.Mutex
+}
+
+// MakeSpool открывает буфер записей в каталоге из настроек. Если каталог не указан, возвращает nil.
+func MakeSpool(settings SpoolSettings) (*Spool, error) {
+	if settings.Dir == "" {
+		return nil, nil
+	}
+
+	s := &Spool{
+		dir:          settings.Dir,
+		maxBytes:     settings.MaxBytes,
+		segmentBytes: settings.SegmentBytes,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultSpoolMaxBytes
+	}
+	if s.segmentBytes <= 0 {
+		s.segmentBytes = defaultSpoolSegmentBytes
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Не удалось создать каталог буфера %s: %s\n", s.dir, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCheckpointFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &s.checkpoint); err != nil {
+			return nil, fmt.Errorf("Ошибка чтения позиции буфера: %s\n", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Ошибка чтения позиции буфера: %s\n", err)
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Ошибка чтения каталога буфера %s: %s\n", s.dir, err)
+	}
+	for _, file := range files {
+		segment, ok := parseSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+		if segment < s.checkpoint.Segment {
+			// Сегмент полностью записан в БД, но не был удален до остановки.
+			_ = os.Remove(s.segmentPath(segment))
+			continue
+		}
+		s.segments = append(s.segments, segment)
+		s.size += file.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if s.size > 0 {
+		log.Printf("В буфере %s есть %v байт не записанных в БД данных.\n", s.dir, s.size)
+	}
+	return s, nil
+}
+
+// Pending проверяет, есть ли в буфере не записанные в БД данные.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 0
+}
+
+// Write добавляет строки таблицы в конец буфера.
+func (s *Spool) Write(entry spoolEntry) error {
+	if entry.Token == "" {
+		token, err := makeDedupToken()
+		if err != nil {
+			return err
+		}
+		entry.Token = token
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(entry); err != nil {
+		return fmt.Errorf("Не удалось подготовить строки для буфера: %s\n", err)
+	}
+	frame := make([]byte, spoolHeaderSize, spoolHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(frame)) > s.maxBytes {
+		return fmt.Errorf("Буфер %s заполнен (%v байт)\n", s.dir, s.size)
+	}
+	if s.current != nil && s.currentSize+int64(len(frame)) > s.segmentBytes {
+		s.closeCurrent()
+	}
+	if s.current == nil {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.current.Write(frame)
+	if err == nil {
+		err = s.current.Sync()
+	}
+	if err != nil {
+		// Следующие записи начинаются с нового сегмента, неполная запись пропускается при чтении.
+		s.closeCurrent()
+		return fmt.Errorf("Ошибка записи в буфер %s: %s\n", s.dir, err)
+	}
+
+	s.currentSize += int64(len(frame))
+	s.size += int64(len(frame))
+	return nil
+}
+
+// Replay передает записи буфера в insert в порядке поступления и удаляет записанные сегменты.
+// Останавливается на первой ошибке insert, следующий вызов продолжает с этой записи.
+// Возвращает количество записанных записей.
+func (s *Spool) Replay(insert func(entry spoolEntry) error) (int, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	// Текущий сегмент закрывается, новые записи добавляются в следующий сегмент.
+	s.mu.Lock()
+	s.closeCurrent()
+	segments := append([]int64(nil), s.segments...)
+	checkpoint := s.checkpoint
+	s.mu.Unlock()
+
+	replayed := 0
+	for _, segment := range segments {
+		var offset int64
+		if segment == checkpoint.Segment {
+			offset = checkpoint.Offset
+		}
+
+		n, err := s.replaySegment(segment, offset, insert)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+
+		if err := s.saveCheckpoint(spoolPosition{Segment: segment + 1}); err != nil {
+			return replayed, err
+		}
+		s.removeSegment(segment)
+	}
+
+	return replayed, nil
+}
+
+// Close закрывает текущий сегмент буфера.
+func (s *Spool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeCurrent()
+}
+
+// replaySegment передает в insert записи сегмента, начиная с позиции offset.
+// Неполная или поврежденная запись в конце сегмента, оставшаяся после сбоя, пропускается вместе с остатком сегмента.
+func (s *Spool) replaySegment(segment, offset int64, insert func(entry spoolEntry) error) (int, error) {
+	path := s.segmentPath(segment)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Ошибка чтения буфера %s: %s\n", path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("Ошибка чтения буфера %s: %s\n", path, err)
+	}
+
+	replayed := 0
+	header := make([]byte, spoolHeaderSize)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err != io.EOF {
+				log.Printf("Неполная запись в конце файла буфера %s пропущена.\n", path)
+			}
+			return replayed, nil
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		if length > s.maxBytes {
+			log.Printf("Поврежденная запись в файле буфера %s пропущена вместе с остатком файла.\n", path)
+			return replayed, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil ||
+			crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			log.Printf("Поврежденная запись в файле буфера %s пропущена вместе с остатком файла.\n", path)
+			return replayed, nil
+		}
+		offset += spoolHeaderSize + length
+
+		var entry spoolEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+			log.Printf("Запись в файле буфера %s пропущена: %s", path, err)
+		} else if err := insert(entry); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+		}
+
+		if err := s.saveCheckpoint(spoolPosition{Segment: segment, Offset: offset}); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+// saveCheckpoint сохраняет позицию записанных в БД данных.
+func (s *Spool) saveCheckpoint(position spoolPosition) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, spoolCheckpointFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("Ошибка сохранения позиции буфера: %s\n", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Ошибка сохранения позиции буфера: %s\n", err)
+	}
+
+	s.mu.Lock()
+	s.checkpoint = position
+	s.mu.Unlock()
+	return nil
+}
+
+// openSegment создает новый сегмент для записи. Вызывается под блокировкой.
+func (s *Spool) openSegment() error {
+	segment := s.checkpoint.Segment
+	if n := len(s.segments); n > 0 && s.segments[n-1] >= segment {
+		segment = s.segments[n-1] + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Ошибка создания файла буфера: %s\n", err)
+	}
+
+	s.current = f
+	s.currentSize = 0
+	s.segments = append(s.segments, segment)
+	return nil
+}
+
+// closeCurrent закрывает текущий сегмент. Вызывается под блокировкой.
+func (s *Spool) closeCurrent() {
+	if s.current == nil {
+		return
+	}
+	if err := s.current.Close(); err != nil {
+		log.Printf("Ошибка закрытия файла буфера: %s", err)
+	}
+	s.current = nil
+}
+
+// removeSegment удаляет записанный в БД сегмент.
+func (s *Spool) removeSegment(segment int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.segmentPath(segment)
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Ошибка удаления файла буфера %s: %s", path, err)
+	}
+
+	for i, v := range s.segments {
+		if v == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+// segmentPath возвращает путь к файлу сегмента.
+func (s *Spool) segmentPath(segment int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", segment, spoolSegmentExt))
+}
+
+// parseSegmentName возвращает номер сегмента по имени файла.
+func parseSegmentName(name string) (int64, bool) {
+	if !strings.HasSuffix(name, spoolSegmentExt) {
+		return 0, false
+	}
+	segment, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+	return segment, err == nil
+}
+
+// makeDedupToken возвращает случайный ключ дедупликации INSERT.
+func makeDedupToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Не удалось создать ключ дедупликации: %s\n", err)
+	}
+	return hex.EncodeToString(b), nil
+}
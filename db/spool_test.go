@@ -0,0 +1,233 @@
+package db
+
+import (
+	"fmt"
+	"mqtt2clickhouse/message"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeTestEntry возвращает строку таблицы с номером n.
+func makeTestEntry(n int) spoolEntry {
+	return spoolEntry{
+		Table: fmt.Sprintf("table%v", n),
+		FieldsType: []message.ColumnsType{
+			{ColName: "n", ColType: "Int64"},
+			{ColName: "time", ColType: "DateTime"},
+			{ColName: "tags", ColType: "Array(String)"},
+		},
+		Rows: [][]message.Pair{{
+			{Name: "n", Value: int64(n)},
+			{Name: "time", Value: time.Unix(int64(n), 0).UTC()},
+			{Name: "tags", Value: []interface{}{"a", "b"}},
+		}},
+	}
+}
+
+// writeTestEntries записывает в буфер строки с номерами от 0 до count-1.
+func writeTestEntries(t *testing.T, spool *Spool, count int) {
+	for i := 0; i < count; i++ {
+		if err := spool.Write(makeTestEntry(i)); err != nil {
+			t.Fatalf("Ошибка записи в буфер: %s", err)
+		}
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir(), SegmentBytes: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	writeTestEntries(t, spool, 5)
+	if !spool.Pending() {
+		t.Fatalf("В буфере должны быть данные")
+	}
+
+	var tables []string
+	tokens := make(map[string]string)
+	insert := func(entry spoolEntry) error {
+		if entry.Table == "table2" && tokens[entry.Table] == "" {
+			tokens[entry.Table] = entry.Token
+			return fmt.Errorf("БД недоступна")
+		}
+		if token, ok := tokens[entry.Table]; ok && token != entry.Token {
+			t.Errorf("Повторная запись должна выполняться с тем же ключом дедупликации")
+		}
+		if v := entry.Rows[0][1].Value; v != time.Unix(int64(len(tables)), 0).UTC() {
+			t.Errorf("Неверное значение времени %v", v)
+		}
+		tables = append(tables, entry.Table)
+		return nil
+	}
+
+	replayed, err := spool.Replay(insert)
+	if err == nil || replayed != 2 {
+		t.Fatalf("Запись должна остановиться на ошибке: записано %v, ошибка %v", replayed, err)
+	}
+
+	// Записи после недоступности БД добавляются в конец буфера.
+	if err := spool.Write(makeTestEntry(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err = spool.Replay(insert)
+	if err != nil || replayed != 4 {
+		t.Fatalf("Записано %v, ошибка %v", replayed, err)
+	}
+
+	expected := "[table0 table1 table2 table3 table4 table5]"
+	if fmt.Sprint(tables) != expected {
+		t.Errorf("Ожидание: %s, факт: %v", expected, tables)
+	}
+	if spool.Pending() {
+		t.Errorf("После записи в буфере не должно остаться данных")
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := MakeSpool(SpoolSettings{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntries(t, spool, 3)
+
+	// Сбой после записи первой строки в БД.
+	count := 0
+	_, _ = spool.Replay(func(entry spoolEntry) error {
+		count++
+		if count > 1 {
+			return fmt.Errorf("БД недоступна")
+		}
+		return nil
+	})
+	spool.Close()
+
+	spool, err = MakeSpool(SpoolSettings{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	var tables []string
+	_, err = spool.Replay(func(entry spoolEntry) error {
+		tables = append(tables, entry.Table)
+		return nil
+	})
+	if err != nil || fmt.Sprint(tables) != "[table1 table2]" {
+		t.Errorf("После перезапуска должны быть записаны только не записанные строки: %v, ошибка %v", tables, err)
+	}
+}
+
+func TestSpoolTornTail(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := MakeSpool(SpoolSettings{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntries(t, spool, 2)
+	spool.Close()
+
+	// Неполная запись в конце сегмента после сбоя.
+	path := spool.segmentPath(spool.segments[0])
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = f.Close()
+
+	spool, err = MakeSpool(SpoolSettings{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	replayed, err := spool.Replay(func(entry spoolEntry) error { return nil })
+	if err != nil || replayed != 2 {
+		t.Errorf("Должны быть записаны строки до неполной записи: %v, ошибка %v", replayed, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt)); len(files) != 0 {
+		t.Errorf("Записанные сегменты должны быть удалены: %v", files)
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir(), MaxBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	var writeErr error
+	for i := 0; i < 100 && writeErr == nil; i++ {
+		writeErr = spool.Write(makeTestEntry(i))
+	}
+	if writeErr == nil {
+		t.Errorf("При превышении размера буфера должна возникать ошибка")
+	}
+	if spool.size > 1024 {
+		t.Errorf("Размер буфера %v превышает лимит", spool.size)
+	}
+}
+
+func TestMakeSpoolDisabled(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{})
+	if spool != nil || err != nil {
+		t.Errorf("Без каталога буфер должен быть выключен")
+	}
+}
+
+func TestSpoolConcurrentWriteReplay(t *testing.T) {
+	spool, err := MakeSpool(SpoolSettings{Dir: t.TempDir(), SegmentBytes: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	const count = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			if err := spool.Write(makeTestEntry(i)); err != nil {
+				t.Errorf("Ошибка записи в буфер: %s", err)
+				return
+			}
+		}
+	}()
+
+	var tables []string
+	insert := func(entry spoolEntry) error {
+		tables = append(tables, entry.Table)
+		return nil
+	}
+
+	writing := true
+	for writing {
+		select {
+		case <-done:
+			writing = false
+		default:
+		}
+		if _, err := spool.Replay(insert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(tables) != count {
+		t.Fatalf("Записано %v строк, ожидание %v", len(tables), count)
+	}
+	for i, table := range tables {
+		if table != fmt.Sprintf("table%v", i) {
+			t.Fatalf("Нарушен порядок записи: строка %v из таблицы %s", i, table)
+		}
+	}
+	if spool.Pending() {
+		t.Errorf("После записи в буфере не должно остаться данных")
+	}
+}
@@ -0,0 +1,98 @@
+// Package deadletter сохраняет сообщения, которые не удалось записать в БД, для последующего разбора и повторной отправки.
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Letter содержит отклоненное сообщение и причину отказа.
+type Letter struct {
+	Topic    string    `json:"topic"`
+	Payload  []byte    `json:"payload"`
+	Received time.Time `json:"received"`
+	Reason   string    `json:"reason"`
+}
+
+// Sink принимает отклоненные сообщения.
+type Sink interface {
+	Send(letter Letter) error
+	Close() error
+}
+
+// FileSink дописывает отклоненные сообщения в файл, по одному сообщению JSON в строке.
+type FileSink struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// MakeFileSink открывает файл для записи отклоненных сообщений.
+func MakeFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Не удалось открыть файл отклоненных сообщений %s: %s\n", path, err)
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+// Send записывает сообщение в файл.
+func (f *FileSink) Send(letter Letter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err = f.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close закрывает файл.
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// publisher отправляет сообщения в mqtt.
+type publisher interface {
+	Publish(topic string, message string) error
+}
+
+// TopicSink отправляет отклоненные сообщения в топик mqtt в формате JSON.
+// Топик не должен совпадать с топиками, на которые подписан клиент, иначе сообщения будут отклоняться повторно.
+type TopicSink struct {
+	client publisher
+	topic  string
+}
+
+// MakeTopicSink возвращает объект для отправки отклоненных сообщений в топик.
+func MakeTopicSink(client publisher, topic string) (*TopicSink, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("Не указан топик для отклоненных сообщений\n")
+	}
+
+	return &TopicSink{client: client, topic: topic}, nil
+}
+
+// Send отправляет сообщение в топик.
+func (t *TopicSink) Send(letter Letter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	return t.client.Publish(t.topic, string(data))
+}
+
+// Close ничего не делает, подключением к mqtt управляет клиент.
+func (t *TopicSink) Close() error {
+	return nil
+}
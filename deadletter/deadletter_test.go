@@ -0,0 +1,92 @@
+package deadletter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testLetter = Letter{
+	Topic:    "/balalaykajazz/plants1/out/sensors/temp_out",
+	Payload:  []byte(`{"value":"broken"`),
+	Received: time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC),
+	Reason:   "unexpected end of JSON input",
+}
+
+type testPublisher struct {
+	topic   string
+	message string
+}
+
+func (p *testPublisher) Publish(topic string, message string) error {
+	p.topic = topic
+	p.message = message
+	return nil
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+
+	sink, err := MakeFileSink(path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть файл: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(testLetter); err != nil {
+			t.Errorf("Ошибка при записи сообщения: %s", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("Ошибка при закрытии файла: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Не удалось прочитать файл: %s", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("В файле должно быть 2 строки, а записано %v", len(lines))
+	}
+
+	var letter Letter
+	if err := json.Unmarshal(lines[0], &letter); err != nil {
+		t.Fatalf("Строка файла должна быть в формате JSON: %s", err)
+	}
+
+	if letter.Topic != testLetter.Topic || !bytes.Equal(letter.Payload, testLetter.Payload) ||
+		!letter.Received.Equal(testLetter.Received) || letter.Reason != testLetter.Reason {
+		t.Errorf("Прочитанное сообщение %v не соответствует записанному %v", letter, testLetter)
+	}
+}
+
+func TestTopicSink(t *testing.T) {
+	_, err := MakeTopicSink(&testPublisher{}, "")
+	if err == nil {
+		t.Errorf("Без указания топика должна возникать ошибка")
+	}
+
+	client := &testPublisher{}
+	sink, err := MakeTopicSink(client, "deadletter")
+	if err != nil {
+		t.Fatalf("Ошибка при создании: %s", err)
+	}
+
+	if err := sink.Send(testLetter); err != nil {
+		t.Errorf("Ошибка при отправке сообщения: %s", err)
+	}
+
+	if client.topic != "deadletter" {
+		t.Errorf("Сообщение отправлено в топик %s вместо deadletter", client.topic)
+	}
+
+	var letter Letter
+	if err := json.Unmarshal([]byte(client.message), &letter); err != nil || letter.Topic != testLetter.Topic {
+		t.Errorf("Отправлено некорректное сообщение %s", client.message)
+	}
+}
@@ -0,0 +1,176 @@
+// Package health описывает проверки работоспособности и готовности приложения для http запросов.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Checker хранит проверки работоспособности (liveness) и готовности (readiness) приложения.
+type Checker struct {
+	mu        sync.RWMutex
+	liveness  map[string]func() error
+	readiness map[string]func() error
+}
+
+// MakeChecker возвращает объект для проверки состояния приложения.
+func MakeChecker() *Checker {
+	return &Checker{
+		liveness:  make(map[string]func() error),
+		readiness: make(map[string]func() error),
+	}
+}
+
+// AddLivenessCheck добавляет проверку работоспособности.
+func (c *Checker) AddLivenessCheck(name string, check func() error) {
+	c.mu.Lock()
+	c.liveness[name] = check
+	c.mu.Unlock()
+}
+
+// AddReadinessCheck добавляет проверку готовности.
+func (c *Checker) AddReadinessCheck(name string, check func() error) {
+	c.mu.Lock()
+	c.readiness[name] = check
+	c.mu.Unlock()
+}
+
+// LivenessHandler возвращает обработчик http запросов для проверки работоспособности.
+func (c *Checker) LivenessHandler() http.Handler {
+	return c.handler(func() map[string]func() error { return c.liveness })
+}
+
+// ReadinessHandler возвращает обработчик http запросов для проверки готовности.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return c.handler(func() map[string]func() error { return c.readiness })
+}
+
+// handler выполняет проверки и возвращает 200, если все проверки успешны, иначе 503 со списком ошибок.
+func (c *Checker) handler(checks func() map[string]func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		names := make([]string, 0, len(checks()))
+		for name := range checks() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var failures []string
+		for _, name := range names {
+			if err := checks()[name](); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", name, strings.TrimSpace(err.Error())))
+			}
+		}
+		c.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failures) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintln(w, strings.Join(failures, "\n"))
+			return
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
+
+// PeriodicCheck выполняет проверку с заданным интервалом и хранит ее последний результат.
+type PeriodicCheck struct {
+	check    func() error
+	interval time.Duration
+	mu       sync.RWMutex
+	lastErr  error
+	quit     chan struct{}
+}
+
+// MakePeriodicCheck возвращает проверку, которая будет выполняться с интервалом interval.
+// До первого выполнения проверка считается неуспешной.
+func MakePeriodicCheck(interval time.Duration, check func() error) *PeriodicCheck {
+	return &PeriodicCheck{
+		check:    check,
+		interval: interval,
+		lastErr:  fmt.Errorf("проверка еще не выполнялась"),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start выполняет проверку сразу и затем с заданным интервалом до вызова Stop.
+func (p *PeriodicCheck) Start() {
+	p.run()
+
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.run()
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop останавливает периодическую проверку.
+func (p *PeriodicCheck) Stop() {
+	close(p.quit)
+}
+
+// Check возвращает результат последней проверки.
+func (p *PeriodicCheck) Check() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastErr
+}
+
+// run выполняет проверку и сохраняет результат.
+func (p *PeriodicCheck) run() {
+	err := p.check()
+	p.mu.Lock()
+	p.lastErr = err
+	p.mu.Unlock()
+}
+
+// Flag признак выполнения события, например первой загрузки настроек.
+type Flag struct {
+	value int32
+}
+
+// Set отмечает, что событие произошло.
+func (f *Flag) Set() {
+	atomic.StoreInt32(&f.value, 1)
+}
+
+// IsSet проверяет, произошло ли событие.
+func (f *Flag) IsSet() bool {
+	return atomic.LoadInt32(&f.value) == 1
+}
+
+// Heartbeat хранит время последнего продвижения в работе горутины.
+type Heartbeat struct {
+	last int64
+}
+
+// MakeHeartbeat возвращает объект с текущим временем последнего продвижения.
+func MakeHeartbeat() *Heartbeat {
+	h := &Heartbeat{}
+	h.Beat()
+	return h
+}
+
+// Beat отмечает продвижение в работе.
+func (h *Heartbeat) Beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+// Since возвращает время, прошедшее с последнего продвижения.
+func (h *Heartbeat) Since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.last)))
+}
@@ -0,0 +1,82 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	c := MakeChecker()
+	mqttErr := error(nil)
+	c.AddReadinessCheck("mqtt", func() error { return mqttErr })
+	c.AddReadinessCheck("clickhouse", func() error { return nil })
+
+	recorder := httptest.NewRecorder()
+	c.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("При успешных проверках должен возвращаться код 200, а вернулся %v", recorder.Code)
+	}
+
+	mqttErr = fmt.Errorf("нет подключения")
+	recorder = httptest.NewRecorder()
+	c.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("При неуспешной проверке должен возвращаться код 503, а вернулся %v", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "mqtt: нет подключения") {
+		t.Errorf("В ответе должна быть указана неуспешная проверка: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	c.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Проверки готовности не должны влиять на работоспособность, код %v", recorder.Code)
+	}
+}
+
+func TestPeriodicCheck(t *testing.T) {
+	checkErr := fmt.Errorf("нет подключения")
+	p := MakePeriodicCheck(time.Hour, func() error { return checkErr })
+
+	if p.Check() == nil {
+		t.Errorf("До первого выполнения проверка должна быть неуспешной")
+	}
+
+	checkErr = nil
+	p.Start()
+	defer p.Stop()
+
+	if p.Check() != nil {
+		t.Errorf("После запуска должен сохраняться результат проверки")
+	}
+}
+
+func TestFlag(t *testing.T) {
+	var f Flag
+	if f.IsSet() {
+		t.Errorf("Новый признак не должен быть установлен")
+	}
+
+	f.Set()
+	if !f.IsSet() {
+		t.Errorf("Признак должен быть установлен после Set")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	h := MakeHeartbeat()
+	h.last = time.Now().Add(-time.Minute).UnixNano()
+
+	if h.Since() < time.Minute {
+		t.Errorf("Время с последнего продвижения должно быть не меньше минуты: %s", h.Since())
+	}
+
+	h.Beat()
+	if h.Since() > time.Second {
+		t.Errorf("После Beat время с последнего продвижения должно сброситься: %s", h.Since())
+	}
+}
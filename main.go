@@ -3,35 +3,263 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"mqtt2clickhouse/client"
 	"mqtt2clickhouse/config"
 	"mqtt2clickhouse/db"
+	"mqtt2clickhouse/deadletter"
+	"mqtt2clickhouse/health"
 	"mqtt2clickhouse/message"
+	"mqtt2clickhouse/metrics"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Коды завершения программы.
+const (
+	exitOK           = 0
+	exitFlushError   = 1
+	exitDrainTimeout = 2
+)
+
+// deliveryQuiet время без новых сообщений от брокера после отписки, после которого очередь записывается в базу.
+const deliveryQuiet = 500 * time.Millisecond
+
+// failedMessages количество сообщений, которые не удалось записать в базу.
+var failedMessages uint64
+
+// writerHeartbeat время последней обработки сообщения из очереди или ожидания пустой очереди.
+var writerHeartbeat = health.MakeHeartbeat()
+
+// topicsLoaded признак получения топиков из consul.
+var topicsLoaded health.Flag
+
 // ReadQueue получает сообщение из очереди, преобразовывает его в подходящий формат для записи и записывает в базу.
-func ReadQueue(explorer *db.ExplorerDB) {
+// Ошибка в одном сообщении не останавливает чтение очереди.
+// После сигнала из QuitChannel дочитывает оставшиеся в очереди сообщения и закрывает done.
+// Пока очередь пуста, heartbeat обновляется периодически, чтобы простой не считался зависанием.
+func ReadQueue(writer *db.BatchWriter, sink deadletter.Sink, done chan<- struct{}) {
+	defer close(done)
+
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
 
 	for {
 		select {
 		case msg := <-message.DataChannel:
-			record, err := message.CreateRecordData(msg.Topic, msg.Value)
-			if err != nil {
-				log.Printf("ошибка при формировании сообщения из топика %s и тела сообщения %s",
-					msg.Topic, msg.Value)
-				return
+			writeMessage(writer, sink, msg)
+			writerHeartbeat.Beat()
+		case <-idle.C:
+			writerHeartbeat.Beat()
+		case <-message.QuitChannel:
+			for {
+				select {
+				case msg := <-message.DataChannel:
+					writeMessage(writer, sink, msg)
+				default:
+					return
+				}
 			}
+		}
+	}
+}
 
-			err = explorer.Recording(record)
-			if err != nil {
-				log.Printf("ошибка при записи сообщения %v", record)
-				return
-			}
-		case <-message.QuitChannel:
-			return
+// writeMessage преобразовывает сообщение и передает его на запись в базу.
+// Сообщения, которые не удалось записать, пропускаются. Отклоненные сообщения отправляются в sink.
+func writeMessage(writer *db.BatchWriter, sink deadletter.Sink, msg *message.Message) {
+	records, err := message.CreateRecordData(msg.Topic, msg.Value, msg.Received)
+	if err != nil {
+		reason := "unknown"
+		var parseErr *message.ParseError
+		if errors.As(err, &parseErr) {
+			reason = parseErr.Reason
 		}
+		metrics.ParseFailures.WithLabelValues(reason).Inc()
+
+		failed := atomic.AddUint64(&failedMessages, 1)
+		log.Printf("ошибка при формировании сообщения из топика %s и тела сообщения %s, "+
+			"сообщение пропущено (всего пропущено %v): %s", msg.Topic, msg.Value, failed, err)
+		sendDeadLetter(sink, msg, err)
+		return
+	}
+
+	err = writer.AddAll(msg, records)
+	if err != nil {
+		rejectMessage(sink, msg, err)
+	}
+}
+
+// rejectMessage учитывает сообщение, которое не удалось записать в базу, и отправляет его в sink.
+// Вызывается при проверке записей сообщения, при ошибке записи пакета, в который они попали,
+// и при ошибке записи этих строк из буфера.
+func rejectMessage(sink deadletter.Sink, msg *message.Message, err error) {
+	failed := atomic.AddUint64(&failedMessages, 1)
+	log.Printf("ошибка при записи сообщения из топика %s, "+
+		"сообщение пропущено (всего пропущено %v): %s", msg.Topic, failed, err)
+	if db.IsTransient(err) {
+		metrics.WriteFailures.WithLabelValues("db").Inc()
+	} else {
+		metrics.WriteFailures.WithLabelValues("schema").Inc()
+	}
+	sendDeadLetter(sink, msg, err)
+}
+
+// sendDeadLetter сохраняет отклоненное сообщение и причину отказа.
+func sendDeadLetter(sink deadletter.Sink, msg *message.Message, reason error) {
+	if sink == nil {
+		return
+	}
+
+	letter := deadletter.Letter{
+		Topic:    msg.Topic,
+		Payload:  msg.Value,
+		Received: msg.Received,
+		Reason:   strings.TrimSpace(reason.Error()),
+	}
+
+	if err := sink.Send(letter); err != nil {
+		log.Printf("ошибка при сохранении отклоненного сообщения из топика %s: %s", msg.Topic, err)
+	}
+}
+
+// makeDeadLetterSink возвращает хранилище отклоненных сообщений указанного вида.
+func makeDeadLetterSink(kind, target string, explorer *db.ExplorerDB, c *client.MqttClient) (deadletter.Sink, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "table":
+		return db.MakeDeadLetterTable(explorer, target)
+	case "file":
+		return deadletter.MakeFileSink(target)
+	case "topic":
+		return deadletter.MakeTopicSink(c, target)
+	default:
+		return nil, fmt.Errorf("Неизвестный вид хранилища отклоненных сообщений %s\n", kind)
+	}
+}
+
+// updateTopics обновляет подписки при изменении списка топиков в consul.
+func updateTopics(c *client.MqttClient, topics map[string]string) {
+	metrics.ConsulReloads.Inc()
+	topicsLoaded.Set()
+
+	c.UpdateSubscriptions(topics)
+}
+
+// startHTTPServer запускает http сервер с метриками и проверками состояния.
+// Если адрес не указан, сервер не запускается.
+func startHTTPServer(addr string, checker *health.Checker) *http.Server {
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return server
+}
+
+// makeChecker возвращает проверки состояния приложения.
+// Готовность: подключение к mqtt, доступность БД и получение топиков из consul.
+// Работоспособность: горутина записи обрабатывает сообщения, когда очередь заполнена.
+func makeChecker(c *client.MqttClient, dbCheck *health.PeriodicCheck, stallTimeout time.Duration) *health.Checker {
+	checker := health.MakeChecker()
+
+	checker.AddReadinessCheck("mqtt", func() error {
+		if !c.IsConnected() {
+			return fmt.Errorf("нет подключения к брокеру")
+		}
+		return nil
+	})
+	checker.AddReadinessCheck("clickhouse", dbCheck.Check)
+	checker.AddReadinessCheck("consul", func() error {
+		if !topicsLoaded.IsSet() {
+			return fmt.Errorf("топики еще не получены")
+		}
+		return nil
+	})
+
+	checker.AddLivenessCheck("writer", func() error {
+		if len(message.DataChannel) == cap(message.DataChannel) && writerHeartbeat.Since() > stallTimeout {
+			return fmt.Errorf("очередь заполнена, последнее сообщение обработано %s назад",
+				writerHeartbeat.Since().Round(time.Second))
+		}
+		return nil
+	})
+
+	return checker
+}
+
+// shutdown прекращает получение новых сообщений и записывает в базу все сообщения из очереди.
+// Очередь дочитывается после того, как брокер перестал доставлять сообщения, отправленные до отписки.
+// Хранилище отклоненных сообщений закрывается и соединение с mqtt разрывается только после записи очереди,
+// потому что хранилище topic публикует отклоненные сообщения через клиент mqtt.
+// Возвращает код завершения программы.
+func shutdown(c *client.MqttClient, writer *db.BatchWriter, sink deadletter.Sink, stopTopics context.CancelFunc,
+	topicsDone <-chan struct{}, queueDone <-chan struct{}, timeout time.Duration) int {
+
+	deadline := time.Now().Add(timeout)
+
+	stopTopics()
+	<-topicsDone
+	c.UnsubscribeAll()
+	if !c.WaitQuiet(deliveryQuiet, timeout) {
+		log.Printf("Сообщения от брокера продолжают поступать после отписки")
+	}
+
+	code := drainQueue(writer, queueDone, time.Until(deadline))
+
+	if sink != nil {
+		if err := sink.Close(); err != nil {
+			log.Printf("Ошибка при закрытии хранилища отклоненных сообщений: %s", err)
+		}
+	}
+	c.Disconnect(250)
+	return code
+}
+
+// drainQueue записывает в базу все сообщения из очереди и накопленные данные.
+// Возвращает код завершения программы.
+func drainQueue(writer *db.BatchWriter, queueDone <-chan struct{}, timeout time.Duration) int {
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case message.QuitChannel <- 0:
+		case <-queueDone:
+		}
+		<-queueDone
+		result <- writer.Close()
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			log.Printf("Ошибка при записи накопленных данных: %s", err)
+			return exitFlushError
+		}
+		log.Println("Все полученные сообщения записаны в БД")
+		return exitOK
+	case <-time.After(timeout):
+		log.Printf("Не удалось записать полученные сообщения в БД за %s", timeout)
+		return exitDrainTimeout
 	}
 }
 
@@ -42,7 +270,27 @@ func main() {
 	broker := flag.String("broker", "", "broker url")
 	port := flag.Int("port", 8883, "broker port")
 	consulHost := flag.String("consulHost", "", "consul url")
-	DBHost := flag.String("DBHost", "", "Database url")
+	consulWaitTime := flag.Duration("consulWaitTime", 5*time.Minute, "Max wait time of consul blocking query")
+	consulMinBackoff := flag.Duration("consulMinBackoff", time.Second, "Initial delay after consul error")
+	consulMaxBackoff := flag.Duration("consulMaxBackoff", time.Minute, "Max delay after consul error")
+	DBHost := flag.String("DBHost", "",
+		"Database urls separated by commas: http://host:8123 for the http driver, clickhouse://host:9000 for native")
+	DBBalance := flag.String("DBBalance", db.BalanceFirstHealthy, "Database replica selection: first-healthy or round-robin")
+	batchSize := flag.Int("batchSize", 1000, "Max rows in one insert")
+	batchInterval := flag.Duration("batchInterval", time.Second, "Max delay before insert")
+	retryAttempts := flag.Int("retryAttempts", 5, "Max attempts of insert on transient database errors")
+	retryDelay := flag.Duration("retryDelay", 500*time.Millisecond, "Initial delay between insert attempts")
+	retryMaxDelay := flag.Duration("retryMaxDelay", 30*time.Second, "Max delay between insert attempts")
+	httpAddr := flag.String("httpAddr", ":9100", "Address of http server with metrics and health checks, empty to disable")
+	pingInterval := flag.Duration("pingInterval", 10*time.Second, "Interval of database availability check")
+	stallTimeout := flag.Duration("stallTimeout", 2*time.Minute, "Max time without progress while the queue is full")
+	deadLetter := flag.String("deadLetter", "", "Where to keep rejected messages: table, file or topic")
+	deadLetterTarget := flag.String("deadLetterTarget", "", "Table name, file path or topic for rejected messages")
+	shutdownTimeout := flag.Duration("shutdownTimeout", 30*time.Second, "Max time to write queued messages on shutdown")
+	schemaRefresh := flag.Duration("schemaRefresh", 5*time.Minute, "Interval of table schema refresh from database, 0 to disable")
+	spoolDir := flag.String("spoolDir", "", "Directory of local buffer for rows while database is unavailable, empty to disable")
+	spoolMaxBytes := flag.Int64("spoolMaxBytes", 1<<30, "Max size of local buffer in bytes")
+	spoolSegmentBytes := flag.Int64("spoolSegmentBytes", 64<<20, "Max size of one local buffer file in bytes")
 	flag.Parse()
 
 	var err error
@@ -67,23 +315,63 @@ func main() {
 
 	c.SignIn(*username, *password)
 	c.SetHandler()
-	mqttConnect := *c.Connecting()
-	defer mqttConnect.Disconnect(250)
+	c.Connecting()
 
 	// Подключение к Consul для получения топиков.
 	kv := config.MakeKVClient()
+	kv.WaitTime = *consulWaitTime
 	_, err = kv.Connect(*consulHost)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Настройки обработки сообщений и записи в БД
+	appSettings, err := config.ReadAppSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = message.Configure(appSettings.Message)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Подключение к БД
 	explorer := db.ExplorerDB{}
-	err = explorer.Connect(*DBHost)
+	err = explorer.SetDriver(appSettings.Driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = explorer.SetEngineSettings(appSettings.Engine)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = explorer.SetSchemaSettings(appSettings.Schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = explorer.SetBalance(*DBBalance)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = explorer.Connect(strings.Split(*DBHost, ",")...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Буфер записей на время недоступности БД
+	spool, err := db.MakeSpool(db.SpoolSettings{Dir: *spoolDir, MaxBytes: *spoolMaxBytes, SegmentBytes: *spoolSegmentBytes})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = explorer.SetSpool(spool)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer explorer.CloseConnect()
 
 	// Загрузка схемы БД
 	err = explorer.LoadTables()
@@ -91,19 +379,72 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// читаем очередь полученных сообщений
-	go ReadQueue(&explorer)
+	// Периодическое обновление схемы БД
+	var schemaCheck *health.PeriodicCheck
+	if *schemaRefresh > 0 {
+		schemaCheck = health.MakePeriodicCheck(*schemaRefresh, func() error {
+			err := explorer.LoadTables()
+			if err != nil {
+				log.Print(err)
+			}
+			return err
+		})
+		schemaCheck.Start()
+	}
 
-	for true {
-		topicsMap, ok, err := kv.LoadTopics()
-		if err != nil {
-			message.QuitChannel <- 0
-			log.Fatal(err)
-		}
+	// Проверки состояния для http сервера
+	dbCheck := health.MakePeriodicCheck(*pingInterval, explorer.Ping)
+	dbCheck.Start()
+	httpServer := startHTTPServer(*httpAddr, makeChecker(&c, dbCheck, *stallTimeout))
+
+	// Пакетная запись в БД
+	writer := db.MakeBatchWriter(&explorer, *batchSize, *batchInterval)
+	writer.SetRetrySettings(db.RetrySettings{Attempts: *retryAttempts, MinDelay: *retryDelay, MaxDelay: *retryMaxDelay})
+
+	// Хранилище отклоненных сообщений
+	sink, err := makeDeadLetterSink(*deadLetter, *deadLetterTarget, &explorer, &c)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if ok {
-			c.UnsubscribeAll()
-			c.SubscribeAll(topicsMap)
+	writer.SetFailureHandler(func(messages []*message.Message, err error) {
+		for _, msg := range messages {
+			rejectMessage(sink, msg, err)
 		}
+	})
+	writer.Start()
+
+	// читаем очередь полученных сообщений
+	queueDone := make(chan struct{})
+	go ReadQueue(writer, sink, queueDone)
+
+	// получаем топики из consul и подписываемся на них
+	watcher := config.MakeTopicWatcher(&kv, *consulMinBackoff, *consulMaxBackoff, func(topics map[string]string) {
+		updateTopics(&c, topics)
+	})
+	topicsCtx, stopTopics := context.WithCancel(context.Background())
+	topicsDone := make(chan struct{})
+	go func() {
+		watcher.Run(topicsCtx)
+		close(topicsDone)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Получен сигнал %s, завершение работы", sig)
+
+	code := shutdown(&c, writer, sink, stopTopics, topicsDone, queueDone, *shutdownTimeout)
+	dbCheck.Stop()
+	if schemaCheck != nil {
+		schemaCheck.Stop()
+	}
+	if spool != nil {
+		spool.Close()
+	}
+	explorer.CloseConnect()
+	if httpServer != nil {
+		_ = httpServer.Close()
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,301 @@
+package message
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Форматы тела сообщения.
+const (
+	FormatJSON      = "json"
+	FormatRaw       = "raw"
+	FormatCSV       = "csv"
+	FormatKV        = "kv"
+	FormatLine      = "line"
+	FormatSparkplug = "sparkplug"
+)
+
+// defaultRawField название поля для значения из сообщения в формате raw.
+const defaultRawField = "value"
+
+// numberRe описывает число в формате JSON.
+var numberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Row строка для записи в БД, полученная из тела сообщения.
+// Table - таблица (если не указана, таблица определяется топиком), Fields - поля строки,
+// Types - типы колонок, заданные форматом сообщения, Time - время строки (если не указано,
+// время берется из поля времени или равно времени получения сообщения).
+type Row struct {
+	Table  string
+	Fields map[string]interface{}
+	Types  map[string]string
+	Time   time.Time
+}
+
+// Decoder преобразовывает тело сообщения в строки для записи в БД.
+type Decoder interface {
+	Decode(payload []byte) ([]Row, error)
+}
+
+// topicDecoder декодер, которому для разбора сообщения нужен топик.
+type topicDecoder interface {
+	DecodeTopic(topic string, payload []byte) ([]Row, error)
+}
+
+// decodePayload разбирает тело сообщения из топика topic.
+func decodePayload(decoder Decoder, topic string, payload []byte) ([]Row, error) {
+	if d, ok := decoder.(topicDecoder); ok {
+		return d.DecodeTopic(topic, payload)
+	}
+	return decoder.Decode(payload)
+}
+
+// PayloadSettings описывает формат тела сообщения.
+// Format - json, raw (одно значение), csv, kv (пары key=value), line (InfluxDB line protocol)
+// или sparkplug (Sparkplug B),
+// Path - путь к массиву строк в сообщении JSON через точку, например samples или data.samples,
+// Field - название поля для значения в формате raw, Header - названия полей в формате csv,
+// Delimiter - разделитель значений в форматах csv и kv (по умолчанию запятая),
+// Precision - единица измерения времени в формате line: ns (по умолчанию), us, ms или s.
+type PayloadSettings struct {
+	Format    string   `json:"format"`
+	Path      string   `json:"path"`
+	Field     string   `json:"field"`
+	Header    []string `json:"header"`
+	Delimiter string   `json:"delimiter"`
+	Precision string   `json:"precision"`
+}
+
+// makeDecoder возвращает декодер тела сообщения для указанных настроек.
+func makeDecoder(p PayloadSettings) (Decoder, error) {
+	delimiter := ','
+	if p.Delimiter != "" {
+		if utf8.RuneCountInString(p.Delimiter) != 1 {
+			return nil, fmt.Errorf("Разделитель значений должен состоять из одного символа, указано '%s'\n",
+				p.Delimiter)
+		}
+		delimiter, _ = utf8.DecodeRuneInString(p.Delimiter)
+	}
+
+	switch p.Format {
+	case "", FormatJSON:
+		if p.Path == "" {
+			return jsonDecoder{}, nil
+		}
+		path := strings.Split(p.Path, ".")
+		for _, name := range path {
+			if name == "" {
+				return nil, fmt.Errorf("Путь к массиву строк '%s' имеет некорректный формат\n", p.Path)
+			}
+		}
+		return jsonDecoder{path: path}, nil
+	case FormatRaw:
+		field := p.Field
+		if field == "" {
+			field = defaultRawField
+		}
+		return rawDecoder{field: field}, nil
+	case FormatCSV:
+		if len(p.Header) == 0 {
+			return nil, fmt.Errorf("Для формата csv не указаны названия полей\n")
+		}
+		return csvDecoder{header: p.Header, delimiter: delimiter}, nil
+	case FormatKV:
+		return kvDecoder{delimiter: string(delimiter)}, nil
+	case FormatLine:
+		precision, ok := linePrecisions[p.Precision]
+		if !ok {
+			return nil, fmt.Errorf("Неизвестная единица измерения времени %s\n", p.Precision)
+		}
+		return lineDecoder{precision: precision}, nil
+	case FormatSparkplug:
+		return makeSparkplugDecoder(), nil
+	}
+
+	return nil, fmt.Errorf("Неизвестный формат сообщения %s\n", p.Format)
+}
+
+// jsonDecoder разбирает сообщение в формате JSON.
+// Объект становится одной строкой, каждый объект массива - отдельной строкой.
+// Если указан path, строки берутся из массива по этому пути, а остальные поля объекта, включая соседние
+// поля массива во вложенных объектах, добавляются в каждую строку,
+// например {"device":"a","samples":[{"value":1},{"value":2}]}.
+type jsonDecoder struct {
+	path []string
+}
+
+// Decode разбирает объект или массив объектов JSON.
+func (j jsonDecoder) Decode(payload []byte) ([]Row, error) {
+	var v interface{}
+	if err := decodeJSON(payload, &v); err != nil {
+		return nil, err
+	}
+
+	if len(j.path) == 0 {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			return []Row{{Fields: value}}, nil
+		case []interface{}:
+			return arrayRows(value, nil)
+		}
+		return nil, fmt.Errorf("Сообщение должно быть объектом или массивом объектов JSON\n")
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Сообщение должно быть объектом JSON с массивом %s\n", strings.Join(j.path, "."))
+	}
+
+	common := withoutPath(m, j.path)
+
+	var value interface{} = m
+	for _, name := range j.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Сообщение не содержит массив %s\n", strings.Join(j.path, "."))
+		}
+		if value, ok = object[name]; !ok {
+			return nil, fmt.Errorf("Сообщение не содержит массив %s\n", strings.Join(j.path, "."))
+		}
+	}
+
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Поле %s должно быть массивом\n", strings.Join(j.path, "."))
+	}
+	return arrayRows(items, common)
+}
+
+// withoutPath возвращает копию объекта без поля по пути path.
+// Вложенные объекты на пути копируются без этого поля, а ставшие пустыми не добавляются.
+func withoutPath(m map[string]interface{}, path []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for name, value := range m {
+		if name != path[0] {
+			result[name] = value
+			continue
+		}
+
+		object, ok := value.(map[string]interface{})
+		if len(path) == 1 || !ok {
+			continue
+		}
+		if rest := withoutPath(object, path[1:]); len(rest) > 0 {
+			result[name] = rest
+		}
+	}
+	return result
+}
+
+// arrayRows возвращает строку для каждого объекта массива items с добавлением полей common.
+// Поля объекта имеют приоритет над полями common.
+func arrayRows(items []interface{}, common map[string]interface{}) ([]Row, error) {
+	rows := make([]Row, 0, len(items))
+	for i, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Элемент массива %v должен быть объектом JSON\n", i)
+		}
+
+		fields := make(map[string]interface{}, len(common)+len(object))
+		for name, value := range common {
+			fields[name] = value
+		}
+		for name, value := range object {
+			fields[name] = value
+		}
+		rows = append(rows, Row{Fields: fields})
+	}
+	return rows, nil
+}
+
+// rawDecoder разбирает сообщение из одного значения, например 23.4.
+type rawDecoder struct {
+	field string
+}
+
+// Decode записывает значение сообщения в поле field.
+func (r rawDecoder) Decode(payload []byte) ([]Row, error) {
+	text := strings.TrimSpace(string(payload))
+	if text == "" {
+		return nil, fmt.Errorf("Сообщение не содержит значения\n")
+	}
+	return []Row{{Fields: map[string]interface{}{r.field: scalarValue(text)}}}, nil
+}
+
+// csvDecoder разбирает строку csv с заданными названиями полей.
+type csvDecoder struct {
+	header    []string
+	delimiter rune
+}
+
+// Decode сопоставляет значения строки csv с названиями полей.
+func (c csvDecoder) Decode(payload []byte) ([]Row, error) {
+	reader := csv.NewReader(bytes.NewReader(payload))
+	reader.Comma = c.delimiter
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 1 {
+		return nil, fmt.Errorf("Сообщение csv должно содержать одну строку, а содержит %v\n", len(records))
+	}
+
+	record := records[0]
+	if len(record) != len(c.header) {
+		return nil, fmt.Errorf("Количество значений csv (%v) не совпадает с количеством полей (%v)\n",
+			len(record), len(c.header))
+	}
+
+	m := make(map[string]interface{}, len(record))
+	for i, name := range c.header {
+		m[name] = scalarValue(record[i])
+	}
+	return []Row{{Fields: m}}, nil
+}
+
+// kvDecoder разбирает сообщение из пар key=value, например temp=23.4,hum=40.
+type kvDecoder struct {
+	delimiter string
+}
+
+// Decode разбирает пары key=value.
+func (k kvDecoder) Decode(payload []byte) ([]Row, error) {
+	m := make(map[string]interface{})
+	for _, pair := range strings.Split(strings.TrimSpace(string(payload)), k.delimiter) {
+		tokens := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(tokens[0])
+		if len(tokens) != 2 || name == "" {
+			return nil, fmt.Errorf("Пара '%s' должна иметь формат key=value\n", pair)
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("Поле '%s' встречается в сообщении несколько раз\n", name)
+		}
+		m[name] = scalarValue(tokens[1])
+	}
+	return []Row{{Fields: m}}, nil
+}
+
+// scalarValue преобразовывает текстовое значение в число, логическое значение, null или строку.
+func scalarValue(text string) interface{} {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return nil
+	case numberRe.MatchString(text):
+		return json.Number(text)
+	case text == "true":
+		return true
+	case text == "false":
+		return false
+	}
+	return text
+}
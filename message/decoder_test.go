@@ -0,0 +1,202 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecoders(t *testing.T) {
+	type testVariant struct {
+		settings PayloadSettings
+		payload  string
+		result   map[string]interface{}
+		isErr    bool
+	}
+
+	testVariants := []*testVariant{
+		{settings: PayloadSettings{}, payload: `{"temp":23.4}`,
+			result: map[string]interface{}{"temp": json.Number("23.4")}},
+		{settings: PayloadSettings{Format: FormatRaw}, payload: " 23.4\n",
+			result: map[string]interface{}{"value": json.Number("23.4")}},
+		{settings: PayloadSettings{Format: FormatRaw, Field: "state"}, payload: "on",
+			result: map[string]interface{}{"state": "on"}},
+		{settings: PayloadSettings{Format: FormatRaw}, payload: " ", isErr: true},
+		{settings: PayloadSettings{Format: FormatCSV, Header: []string{"temp", "hum", "ok"}}, payload: "23.4, 40,true",
+			result: map[string]interface{}{"temp": json.Number("23.4"), "hum": json.Number("40"), "ok": true}},
+		{settings: PayloadSettings{Format: FormatCSV, Header: []string{"temp", "hum"}, Delimiter: ";"},
+			payload: `23.4;"high"`, result: map[string]interface{}{"temp": json.Number("23.4"), "hum": "high"}},
+		{settings: PayloadSettings{Format: FormatCSV, Header: []string{"temp", "hum"}}, payload: "23.4", isErr: true},
+		{settings: PayloadSettings{Format: FormatCSV, Header: []string{"temp"}}, payload: "1\n2", isErr: true},
+		{settings: PayloadSettings{Format: FormatKV}, payload: "temp=23.4,hum=40,note=",
+			result: map[string]interface{}{"temp": json.Number("23.4"), "hum": json.Number("40"), "note": nil}},
+		{settings: PayloadSettings{Format: FormatKV, Delimiter: " "}, payload: "temp=0x10 mode=auto",
+			result: map[string]interface{}{"temp": "0x10", "mode": "auto"}},
+		{settings: PayloadSettings{Format: FormatKV}, payload: "temp=1,temp=2", isErr: true},
+		{settings: PayloadSettings{Format: FormatKV}, payload: "temp", isErr: true},
+	}
+
+	for i, v := range testVariants {
+		decoder, err := makeDecoder(v.settings)
+		if err != nil {
+			t.Errorf("№%v. Ошибка создания декодера: %s", i, err)
+			continue
+		}
+
+		rows, err := decoder.Decode([]byte(v.payload))
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+			continue
+		}
+		if !v.isErr && (len(rows) != 1 || !reflect.DeepEqual(rows[0].Fields, v.result)) {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.result, rows)
+		}
+	}
+}
+
+func TestJSONArrayDecoder(t *testing.T) {
+	type testVariant struct {
+		path    string
+		payload string
+		result  []map[string]interface{}
+		isErr   bool
+	}
+
+	testVariants := []*testVariant{
+		{payload: `[{"ts":1,"value":2},{"ts":3,"value":4}]`,
+			result: []map[string]interface{}{
+				{"ts": json.Number("1"), "value": json.Number("2")},
+				{"ts": json.Number("3"), "value": json.Number("4")},
+			}},
+		{payload: `[]`, result: []map[string]interface{}{}},
+		{payload: `[1,2]`, isErr: true},
+		{payload: `"text"`, isErr: true},
+		{path: "samples", payload: `{"device":"a","samples":[{"value":1},{"value":2,"device":"b"}]}`,
+			result: []map[string]interface{}{
+				{"device": "a", "value": json.Number("1")},
+				{"device": "b", "value": json.Number("2")},
+			}},
+		{path: "data.samples", payload: `{"data":{"samples":[{"value":1}]}}`,
+			result: []map[string]interface{}{{"value": json.Number("1")}}},
+		{path: "data.samples", payload: `{"site":"x","data":{"device":"a","samples":[{"value":1}]}}`,
+			result: []map[string]interface{}{{
+				"site":  "x",
+				"data":  map[string]interface{}{"device": "a"},
+				"value": json.Number("1"),
+			}}},
+		{path: "samples", payload: `{"value":1}`, isErr: true},
+		{path: "samples", payload: `{"samples":{"value":1}}`, isErr: true},
+		{path: "samples", payload: `[{"value":1}]`, isErr: true},
+	}
+
+	for i, v := range testVariants {
+		decoder, err := makeDecoder(PayloadSettings{Format: FormatJSON, Path: v.path})
+		if err != nil {
+			t.Errorf("№%v. Ошибка создания декодера: %s", i, err)
+			continue
+		}
+
+		rows, err := decoder.Decode([]byte(v.payload))
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+			continue
+		}
+		if v.isErr {
+			continue
+		}
+
+		result := make([]map[string]interface{}, len(rows))
+		for j, row := range rows {
+			result[j] = row.Fields
+		}
+		if !reflect.DeepEqual(result, v.result) {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.result, result)
+		}
+	}
+}
+
+func TestJSONArrayRecords(t *testing.T) {
+	defer func() { _ = Configure(DefaultSettings()) }()
+
+	s := DefaultSettings()
+	s.Timestamp.Field = "ts"
+	s.Topics = []TopicSettings{
+		{Filter: "/+/+/buffer/#", Payload: &PayloadSettings{Format: FormatJSON, Path: "samples"}},
+	}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка применения настроек: %s", err)
+	}
+
+	payload := `{"samples":[{"ts":1637834400,"value":1.5},{"ts":1637834460,"value":2.5}]}`
+	records, err := CreateRecordData("/balalaykajazz/plants1/buffer/temp_out", []byte(payload), time.Now())
+	if err != nil {
+		t.Fatalf("Ошибка преобразования сообщения: %s", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Сообщение должно содержать 2 записи, а содержит %v", len(records))
+	}
+
+	for i, value := range []float64{1.5, 2.5} {
+		fields := records[i]["fields"].([]Pair)
+		expected := []Pair{
+			{"client", "balalaykajazz"},
+			{"device", "plants1"},
+			{"value", value},
+			{timestampColumn, time.Unix(1637834400+int64(i)*60, 0).UTC()},
+		}
+		if !reflect.DeepEqual(fields, expected) {
+			t.Errorf("Запись %v. Ожидание: %v, факт: %v", i, expected, fields)
+		}
+	}
+}
+
+func TestMakeDecoderErrors(t *testing.T) {
+	testVariants := []PayloadSettings{
+		{Format: "xml"},
+		{Format: FormatCSV},
+		{Format: FormatKV, Delimiter: ";;"},
+		{Format: FormatJSON, Path: "data..samples"},
+	}
+
+	for i, v := range testVariants {
+		if _, err := makeDecoder(v); err == nil {
+			t.Errorf("№%v. Для настроек %v должна возникать ошибка", i, v)
+		}
+	}
+}
+
+func TestTopicPayloadFormat(t *testing.T) {
+	defer func() { _ = Configure(DefaultSettings()) }()
+
+	s := DefaultSettings()
+	s.Topics = []TopicSettings{
+		{Filter: "/+/+/raw/#", Payload: &PayloadSettings{Format: FormatRaw, Field: "temp"}},
+		{Filter: "/+/+/kv/#", Payload: &PayloadSettings{Format: FormatKV}},
+	}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка применения настроек: %s", err)
+	}
+
+	received := time.Date(2021, 11, 25, 10, 0, 0, 0, time.UTC)
+	expected, err := CreateRecordData("/balalaykajazz/plants1/json/temp_out", []byte(`{"temp":23.4}`), received)
+	if err != nil {
+		t.Fatalf("Ошибка преобразования сообщения json: %s", err)
+	}
+
+	for _, topic := range []string{"/balalaykajazz/plants1/raw/temp_out", "/balalaykajazz/plants1/kv/temp_out"} {
+		payload := "23.4"
+		if topic == "/balalaykajazz/plants1/kv/temp_out" {
+			payload = "temp=23.4"
+		}
+
+		recordData, err := CreateRecordData(topic, []byte(payload), received)
+		if err != nil {
+			t.Errorf("Ошибка преобразования сообщения из топика %s: %s", topic, err)
+			continue
+		}
+		if !reflect.DeepEqual(recordData, expected) {
+			t.Errorf("Топик %s. Ожидание: %v, факт: %v", topic, expected, recordData)
+		}
+	}
+}
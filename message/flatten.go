@@ -0,0 +1,71 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// FlattenSettings описывает раскрытие вложенных объектов сообщения в отдельные колонки.
+// Separator соединяет названия вложенных полей, MaxDepth ограничивает глубину раскрытия (0 - без ограничения),
+// Raw - поля, которые записываются строкой JSON без раскрытия.
+type FlattenSettings struct {
+	Separator string   `json:"separator"`
+	MaxDepth  int      `json:"maxDepth"`
+	Raw       []string `json:"raw"`
+}
+
+// validate проверяет корректность настроек раскрытия.
+func (f FlattenSettings) validate() error {
+	if f.Separator == "" {
+		return fmt.Errorf("Не указан разделитель названий вложенных полей\n")
+	}
+	if f.MaxDepth < 0 {
+		return fmt.Errorf("Максимальная глубина раскрытия не может быть отрицательной\n")
+	}
+	return nil
+}
+
+// flatten раскрывает вложенные объекты сообщения в поля с составными названиями, например battery_voltage.
+// Объекты глубже MaxDepth и поля из Raw записываются строкой JSON.
+func (f FlattenSettings) flatten(m map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(m))
+	err := f.flattenInto(result, "", m, 1)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// flattenInto добавляет в result поля объекта m с префиксом prefix.
+func (f FlattenSettings) flattenInto(result map[string]interface{}, prefix string, m map[string]interface{},
+	depth int) error {
+
+	for key, value := range m {
+		name := key
+		if prefix != "" {
+			name = prefix + f.Separator + key
+		}
+
+		if nested, ok := value.(map[string]interface{}); ok {
+			if !containsString(f.Raw, name) && (f.MaxDepth == 0 || depth < f.MaxDepth) {
+				if err := f.flattenInto(result, name, nested, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+
+			raw, err := json.Marshal(nested)
+			if err != nil {
+				return err
+			}
+			value = string(raw)
+		}
+
+		if _, ok := result[name]; ok {
+			return fmt.Errorf("Поле '%s' встречается в сообщении несколько раз после раскрытия вложенных объектов\n", name)
+		}
+		result[name] = value
+	}
+
+	return nil
+}
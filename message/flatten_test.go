@@ -0,0 +1,82 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	message := `{"battery":{"voltage":3.1,"level":80},"rssi":-70,"meta":{"fw":{"version":"1.2","build":7}}}`
+
+	type testVariant struct {
+		settings FlattenSettings
+		result   map[string]interface{}
+	}
+
+	testVariants := []*testVariant{
+		{
+			settings: FlattenSettings{Separator: "_"},
+			result: map[string]interface{}{
+				"battery_voltage": 3.1, "battery_level": float64(80), "rssi": float64(-70),
+				"meta_fw_version": "1.2", "meta_fw_build": float64(7),
+			},
+		},
+		{
+			settings: FlattenSettings{Separator: ".", MaxDepth: 2},
+			result: map[string]interface{}{
+				"battery.voltage": 3.1, "battery.level": float64(80), "rssi": float64(-70),
+				"meta.fw": `{"build":7,"version":"1.2"}`,
+			},
+		},
+		{
+			settings: FlattenSettings{Separator: "_", Raw: []string{"battery"}},
+			result: map[string]interface{}{
+				"battery": `{"level":80,"voltage":3.1}`, "rssi": float64(-70),
+				"meta_fw_version": "1.2", "meta_fw_build": float64(7),
+			},
+		},
+	}
+
+	for i, v := range testVariants {
+		m := make(map[string]interface{})
+		_ = json.Unmarshal([]byte(message), &m)
+
+		result, err := v.settings.flatten(m)
+		if err != nil {
+			t.Errorf("№%v. Ошибка при раскрытии вложенных объектов: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, v.result) {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.result, result)
+		}
+	}
+
+	m := make(map[string]interface{})
+	_ = json.Unmarshal([]byte(`{"battery":{"level":80},"battery_level":81}`), &m)
+	_, err := FlattenSettings{Separator: "_"}.flatten(m)
+	if err == nil {
+		t.Errorf("При совпадении названий полей после раскрытия должна возникать ошибка")
+	}
+}
+
+func TestFlattenSettingsValidate(t *testing.T) {
+	type testVariant struct {
+		settings FlattenSettings
+		isErr    bool
+	}
+
+	testVariants := []*testVariant{
+		{settings: FlattenSettings{Separator: "_"}, isErr: false},
+		{settings: FlattenSettings{Separator: "_", MaxDepth: 2}, isErr: false},
+		{settings: FlattenSettings{Separator: ""}, isErr: true},
+		{settings: FlattenSettings{Separator: "_", MaxDepth: -1}, isErr: true},
+	}
+
+	for i, v := range testVariants {
+		err := v.settings.validate()
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagColumnType тип колонок для тегов line protocol.
+const tagColumnType = "LowCardinality(String)"
+
+// linePrecisions единицы измерения времени строки line protocol.
+var linePrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// lineDecoder разбирает сообщение в формате InfluxDB line protocol:
+// measurement,tag=value field=value timestamp. Каждая строка сообщения становится отдельной строкой для записи,
+// measurement определяет таблицу, теги записываются в колонки LowCardinality(String).
+type lineDecoder struct {
+	precision time.Duration
+}
+
+// Decode разбирает строки line protocol. Пустые строки и комментарии пропускаются.
+func (l lineDecoder) Decode(payload []byte) ([]Row, error) {
+	var rows []Row
+	for i, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		row, err := l.decodeLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("Строка %v: %s", i+1, err)
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("Сообщение не содержит строк line protocol\n")
+	}
+	return rows, nil
+}
+
+// decodeLine разбирает одну строку line protocol.
+func (l lineDecoder) decodeLine(line string) (Row, error) {
+	sections := splitEscaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return Row{}, fmt.Errorf("Строка '%s' должна содержать measurement, поля и время\n", line)
+	}
+
+	row := Row{
+		Fields: make(map[string]interface{}),
+		Types:  make(map[string]string),
+	}
+
+	key := splitEscaped(sections[0], ',', false)
+	row.Table = unescape(key[0])
+	if row.Table == "" {
+		return Row{}, fmt.Errorf("Не указан measurement\n")
+	}
+
+	for _, tag := range key[1:] {
+		name, value, err := splitPair(tag)
+		if err != nil {
+			return Row{}, err
+		}
+		if _, ok := row.Fields[name]; ok {
+			return Row{}, fmt.Errorf("Тег '%s' встречается несколько раз\n", name)
+		}
+		row.Fields[name] = unescape(value)
+		row.Types[name] = tagColumnType
+	}
+
+	for _, field := range splitEscaped(sections[1], ',', true) {
+		name, value, err := splitPair(field)
+		if err != nil {
+			return Row{}, err
+		}
+		if _, ok := row.Fields[name]; ok {
+			return Row{}, fmt.Errorf("Поле '%s' встречается несколько раз\n", name)
+		}
+
+		row.Fields[name], err = lineFieldValue(value)
+		if err != nil {
+			return Row{}, fmt.Errorf("Поле '%s': %s", name, err)
+		}
+	}
+
+	if len(sections) == 3 {
+		timestamp, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Row{}, fmt.Errorf("Время '%s' имеет некорректный формат\n", sections[2])
+		}
+		row.Time = time.Unix(0, timestamp*int64(l.precision)).UTC()
+	}
+
+	return row, nil
+}
+
+// lineFieldValue преобразовывает значение поля line protocol:
+// 1.5 - дробное число, 1i - целое число, 1u - беззнаковое целое число, "text" - строка, t/f - логическое значение.
+func lineFieldValue(value string) (interface{}, error) {
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		text := value[1 : len(value)-1]
+		text = strings.ReplaceAll(text, `\"`, `"`)
+		return strings.ReplaceAll(text, `\\`, `\`), nil
+	case strings.HasSuffix(value, "i"):
+		if i, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64); err == nil {
+			return i, nil
+		}
+		return nil, fmt.Errorf("Значение '%s' имеет некорректный формат\n", value)
+	case strings.HasSuffix(value, "u"):
+		if u, err := strconv.ParseUint(strings.TrimSuffix(value, "u"), 10, 64); err == nil {
+			return u, nil
+		}
+		return nil, fmt.Errorf("Значение '%s' имеет некорректный формат\n", value)
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Значение '%s' имеет некорректный формат\n", value)
+	}
+	return f, nil
+}
+
+// splitPair разделяет пару key=value по первому неэкранированному знаку '='.
+func splitPair(pair string) (string, string, error) {
+	tokens := splitEscaped(pair, '=', false)
+	if len(tokens) < 2 || tokens[0] == "" {
+		return "", "", fmt.Errorf("Пара '%s' должна иметь формат key=value\n", pair)
+	}
+	return unescape(tokens[0]), strings.Join(tokens[1:], "="), nil
+}
+
+// splitEscaped разделяет строку по символу sep, пропуская экранированные символы
+// и, если quotes, символы внутри кавычек.
+func splitEscaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape убирает экранирование запятых, пробелов и знаков '=' в названиях и тегах.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`).Replace(s)
+}
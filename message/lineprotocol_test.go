@@ -0,0 +1,116 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLineDecoder(t *testing.T) {
+	payload := `weather,location=us\ midwest,season=summer temperature=82,humidity=71i,ok=t,note="a \"b\", c" 1465839830100400200
+# комментарий
+
+cpu\,total usage=5u`
+
+	decoder, err := makeDecoder(PayloadSettings{Format: FormatLine})
+	if err != nil {
+		t.Fatalf("Ошибка создания декодера: %s", err)
+	}
+
+	rows, err := decoder.Decode([]byte(payload))
+	if err != nil {
+		t.Fatalf("Ошибка разбора line protocol: %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Сообщение должно содержать 2 строки, а содержит %v", len(rows))
+	}
+
+	expected := Row{
+		Table: "weather",
+		Fields: map[string]interface{}{
+			"location":    "us midwest",
+			"season":      "summer",
+			"temperature": 82.0,
+			"humidity":    int64(71),
+			"ok":          true,
+			"note":        `a "b", c`,
+		},
+		Types: map[string]string{"location": tagColumnType, "season": tagColumnType},
+		Time:  time.Unix(0, 1465839830100400200).UTC(),
+	}
+	if !reflect.DeepEqual(rows[0], expected) {
+		t.Errorf("Ожидание: %v, факт: %v", expected, rows[0])
+	}
+
+	if rows[1].Table != "cpu,total" || !rows[1].Time.IsZero() {
+		t.Errorf("Некорректная строка без времени: %v", rows[1])
+	}
+}
+
+func TestLineDecoderErrors(t *testing.T) {
+	testVariants := []string{
+		"weather",
+		"weather temperature",
+		"weather temperature=hot",
+		"weather temperature=1 yesterday",
+		"weather,location=a location=1",
+		",location=a temperature=1",
+		"# только комментарий",
+	}
+
+	decoder := lineDecoder{precision: time.Nanosecond}
+	for i, v := range testVariants {
+		if _, err := decoder.Decode([]byte(v)); err == nil {
+			t.Errorf("№%v. Для строки '%s' должна возникать ошибка", i, v)
+		}
+	}
+}
+
+func TestLineProtocolRecords(t *testing.T) {
+	defer func() { _ = Configure(DefaultSettings()) }()
+
+	s := DefaultSettings()
+	s.Topics = []TopicSettings{{
+		Filter:    "telegraf/#",
+		Templates: []string{"telegraf/{host}"},
+		Payload:   &PayloadSettings{Format: FormatLine, Precision: "s"},
+	}}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка применения настроек: %s", err)
+	}
+
+	payload := "cpu,core=0 usage=0.5 1637785643\ncpu,core=1 usage=0.7 1637785643\nmem used=10i 1637785643"
+	records, err := CreateRecordData("telegraf/node1", []byte(payload), time.Now())
+	if err != nil {
+		t.Fatalf("Ошибка преобразования сообщения: %s", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Сообщение должно дать 3 записи, а дало %v", len(records))
+	}
+
+	timestamp := time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)
+	expectedFields := []Pair{
+		{"host", "node1"},
+		{"core", "1"},
+		{"usage", 0.7},
+		{"timestamp", timestamp},
+	}
+	expectedTypes := []ColumnsType{
+		{"host", "String"},
+		{"core", tagColumnType},
+		{"usage", "Float64"},
+		{"timestamp", "DateTime64(3)"},
+	}
+	if records[1]["tableName"] != "cpu" || !reflect.DeepEqual(records[1]["fields"], expectedFields) ||
+		!reflect.DeepEqual(records[1]["fieldsType"], expectedTypes) {
+		t.Errorf("Ожидание: cpu %v %v, факт: %v", expectedFields, expectedTypes, records[1])
+	}
+	if records[2]["tableName"] != "mem" {
+		t.Errorf("Таблица третьей записи должна определяться measurement: %v", records[2]["tableName"])
+	}
+
+	_, err = CreateRecordData("/balalaykajazz/plants1/out/sensors", []byte(`{"value":1}`), time.Now())
+	if err != nil {
+		t.Errorf("Для топика json должна использоваться таблица из шаблона: %s", err)
+	}
+}
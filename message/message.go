@@ -2,15 +2,16 @@
 package message
 
 import (
-	"encoding/json"
 	"fmt"
-	"strings"
+	"sort"
+	"time"
 )
 
 // Message структура сообщения из mqtt.
 type Message struct {
-	Topic string
-	Value []byte
+	Topic    string
+	Value    []byte
+	Received time.Time
 }
 
 // DataChannel канал для передачи сообщий от брокера в БД.
@@ -34,114 +35,301 @@ type Pair struct {
 	Value interface{}
 }
 
-// checkTopic проверяет валидность топика сообщения.
-func checkTopic(topic string) (bool, error) {
-	if !strings.HasPrefix(topic, "/") {
-		return false, fmt.Errorf("Топик '%s' не содержит префикс '/'\n", topic)
+// Причины ошибок преобразования сообщения.
+const (
+	ReasonTopic      = "topic"
+	ReasonPayload    = "payload"
+	ReasonTimestamp  = "timestamp"
+	ReasonColumnType = "column_type"
+)
+
+// ParseError ошибка преобразования сообщения с указанием причины.
+type ParseError struct {
+	Reason string
+	Err    error
+}
+
+// Error возвращает текст исходной ошибки.
+func (p *ParseError) Error() string {
+	return p.Err.Error()
+}
+
+// Unwrap возвращает исходную ошибку.
+func (p *ParseError) Unwrap() error {
+	return p.Err
+}
+
+// parseError добавляет к ошибке причину, если она еще не указана.
+func parseError(reason string, err error) error {
+	if _, ok := err.(*ParseError); ok {
+		return err
+	}
+	return &ParseError{Reason: reason, Err: err}
+}
+
+// Settings содержит настройки преобразования сообщений для записи в БД.
+// Payload - формат тела сообщения, Types - определение типов колонок, Templates - шаблоны топиков, применяется первый подходящий шаблон.
+// Topics - настройки для отдельных топиков, применяются настройки первого подходящего фильтра.
+type Settings struct {
+	Timestamp TimestampSettings `json:"timestamp"`
+	Payload   PayloadSettings   `json:"payload"`
+	Flatten   FlattenSettings   `json:"flatten"`
+	Types     TypeSettings      `json:"types"`
+	Templates []string          `json:"templates"`
+	Topics    []TopicSettings   `json:"topics"`
+
+	decoder   Decoder
+	templates []topicTemplate
+}
+
+// settings текущие настройки преобразования сообщений.
+var settings Settings
+
+func init() {
+	if err := Configure(DefaultSettings()); err != nil {
+		panic(err)
 	}
+}
 
-	if strings.Count(topic, "/") < 4 {
-		return false, fmt.Errorf("Топик '%s' должен иметь формат '/client/device/../sensorName'\n", topic)
+// DefaultSettings возвращает настройки преобразования сообщений по умолчанию.
+func DefaultSettings() Settings {
+	return Settings{
+		Timestamp: TimestampSettings{Field: timestampColumn, Precision: 3},
+		Payload:   PayloadSettings{Format: FormatJSON},
+		Flatten:   FlattenSettings{Separator: "_", MaxDepth: 3},
+		Types:     TypeSettings{Bool: boolTypeUInt8},
+		Templates: []string{defaultTemplate},
 	}
-	return true, nil
 }
 
-// getDataFromTopic заполняет поля для записи в БД из топика сообщения.
-func (d *DataRecord) getDataFromTopic(topic string) error {
-	topicFields := strings.Split(topic, "/")
+// Configure задает настройки преобразования сообщений.
+func Configure(s Settings) error {
+	if err := s.Timestamp.validate(); err != nil {
+		return err
+	}
+	if err := s.Flatten.validate(); err != nil {
+		return err
+	}
+	if err := s.Types.validate(); err != nil {
+		return err
+	}
+
+	var err error
+	s.decoder, err = makeDecoder(s.Payload)
+	if err != nil {
+		return err
+	}
+
+	s.templates, err = parseTemplates(s.Templates)
+	if err != nil {
+		return err
+	}
+	if len(s.templates) == 0 {
+		return fmt.Errorf("Не указаны шаблоны топиков\n")
+	}
+
+	topics := make([]TopicSettings, len(s.Topics))
+	for i, topicSettings := range s.Topics {
+		if topicSettings.Flatten != nil {
+			if err := topicSettings.Flatten.validate(); err != nil {
+				return fmt.Errorf("Фильтр %s: %s", topicSettings.Filter, err)
+			}
+		}
 
-	(*d)["tableName"] = topicFields[len(topicFields)-1]
+		if topicSettings.Payload != nil {
+			topicSettings.decoder, err = makeDecoder(*topicSettings.Payload)
+			if err != nil {
+				return fmt.Errorf("Фильтр %s: %s", topicSettings.Filter, err)
+			}
+		}
 
-	(*d)["fields"] = []Pair{
-		{Name: "client", Value: topicFields[1]},
-		{Name: "device", Value: topicFields[2]},
+		topicSettings.templates, err = parseTemplates(topicSettings.Templates)
+		if err != nil {
+			return fmt.Errorf("Фильтр %s: %s", topicSettings.Filter, err)
+		}
+		topics[i] = topicSettings
 	}
+	s.Topics = topics
 
+	settings = s
 	return nil
 }
 
-// getDataFromMessage заполняет поля для записи в БД из тела сообщения.
-func (d *DataRecord) getDataFromMessage(message []byte) error {
-	m := make(map[string]interface{})
+// checkTopic проверяет, что топик сообщения соответствует шаблону.
+func checkTopic(topic string) (bool, error) {
+	_, _, err := matchTemplates(settings.forTopic(topic).topicTemplates(), topic)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	err := json.Unmarshal(message, &m)
+// getDataFromTopic заполняет поля для записи в БД из топика сообщения.
+// Поле шаблона {table} определяет таблицу, остальные именованные поля записываются в колонки.
+// Если шаблон не содержит {table}, используется таблица из настроек топика.
+func (d *DataRecord) getDataFromTopic(topic string) error {
+	topicSettings := settings.forTopic(topic)
+	tableName, fields, err := matchTemplates(topicSettings.topicTemplates(), topic)
 	if err != nil {
 		return err
 	}
+	if tableName == "" {
+		tableName = topicSettings.Table
+	}
 
-	valField, ok := m["value"]
-	if !ok {
-		return fmt.Errorf("Отсутствует поле 'value' в сообщении %s\n", message)
+	(*d)["tableName"] = tableName
+	(*d)["fields"] = fields
+
+	return nil
+}
+
+// getDataFromMessage разбирает тело сообщения декодером формата топика и возвращает записи для каждой строки.
+// Поля из топика, заполненные в d, добавляются в каждую запись. Служебные сообщения, например
+// NDEATH в формате Sparkplug B, не содержат строк, для них возвращается пустой список записей.
+func (d DataRecord) getDataFromMessage(topic string, message []byte, received time.Time,
+	topicSettings TopicSettings) ([]DataRecord, error) {
+
+	rows, err := decodePayload(topicSettings.payloadDecoder(), topic, message)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]DataRecord, 0, len(rows))
+	for _, row := range rows {
+		recordData := DataRecord{"tableName": d["tableName"], "fields": d["fields"]}
+		if row.Table != "" {
+			recordData["tableName"] = row.Table
+		}
+		if tableName, _ := recordData["tableName"].(string); tableName == "" {
+			return nil, parseError(ReasonTopic, fmt.Errorf("Не удалось определить таблицу для записи\n"))
+		}
+
+		err = recordData.getDataFromRow(row, received, topicSettings)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, recordData)
+	}
+
+	return records, nil
+}
+
+// getDataFromRow заполняет поля для записи в БД из строки сообщения.
+// Вложенные объекты раскрываются, затем каждое поле записывается в отдельную колонку,
+// поля сортируются по названию.
+// Время записи берется из строки или поля сообщения, а при их отсутствии равно времени получения сообщения.
+func (d *DataRecord) getDataFromRow(row Row, received time.Time, topicSettings TopicSettings) error {
+	m, err := topicSettings.flattenSettings().flatten(row.Fields)
+	if err != nil {
+		return err
 	}
 
 	fieldsInterface := (*d)["fields"]
-	fields, ok := fieldsInterface.([]Pair)
+	topicFields, ok := fieldsInterface.([]Pair)
 	if !ok {
-		return fmt.Errorf("Ошибка при добавлении 'value' в структуру записи\n")
+		return fmt.Errorf("Ошибка при добавлении полей сообщения в структуру записи\n")
+	}
+	fields := append([]Pair(nil), topicFields...)
+
+	timestamp := received.UTC()
+	if tsField, ok := m[settings.Timestamp.Field]; ok && settings.Timestamp.Field != "" {
+		timestamp, err = ParseTimestamp(tsField)
+		if err != nil {
+			return parseError(ReasonTimestamp, err)
+		}
+		delete(m, settings.Timestamp.Field)
+	}
+	if !row.Time.IsZero() {
+		timestamp = row.Time.UTC()
 	}
 
-	fields = append(fields, Pair{Name: "value", Value: valField})
+	names := make([]string, 0, len(m))
+	for name := range m {
+		if topicSettings.allowField(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("В сообщении нет полей для записи\n")
+	}
+	sort.Strings(names)
 
-	fieldsType, err := createColumnDesc(fields)
-	if err != nil {
+	for _, name := range names {
+		value := m[name]
+		if _, ok := row.Types[name]; !ok {
+			value = settings.Types.normalizeValue(name, value)
+		}
+		fields = append(fields, Pair{Name: name, Value: value})
+	}
+	fields = append(fields, Pair{Name: timestampColumn, Value: timestamp})
+
+	if err := checkDuplicates(fields); err != nil {
 		return err
 	}
 
+	fieldsType, err := createColumnDesc(fields, row.Types)
+	if err != nil {
+		return parseError(ReasonColumnType, err)
+	}
+
 	(*d)["fields"] = fields
 	(*d)["fieldsType"] = fieldsType
 
 	return nil
 }
 
+// checkDuplicates проверяет, что названия полей записи не повторяются.
+func checkDuplicates(fields []Pair) error {
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if names[field.Name] {
+			return fmt.Errorf("Поле '%s' встречается в записи несколько раз\n", field.Name)
+		}
+		names[field.Name] = true
+	}
+	return nil
+}
+
 // createColumnDesc формирует описание таблицы для записи в бд.
-func createColumnDesc(fields []Pair) ([]ColumnsType, error) {
+// Типы из настроек колонок имеют приоритет над типами формата сообщения hints.
+func createColumnDesc(fields []Pair, hints map[string]string) ([]ColumnsType, error) {
 	fieldsType := make([]ColumnsType, len(fields))
-	for i := 0; i < len(fields); i++ {
-		v := fields[i]
-
-		var ok = true
-		var valTypeStr string
-
-		switch v.Value.(type) {
-		case int:
-			valTypeStr = fmt.Sprintf("%T", v.Value.(int))
-		case float64:
-			valTypeStr = fmt.Sprintf("%T", v.Value.(float64))
-		case string:
-			valTypeStr = fmt.Sprintf("%T", v.Value.(string))
-		default:
-			ok = false
+	for i, field := range fields {
+		if colType, ok := hints[field.Name]; ok {
+			if _, ok := settings.Types.Columns[field.Name]; !ok {
+				fieldsType[i] = ColumnsType{ColName: field.Name, ColType: colType}
+				continue
+			}
 		}
 
-		if !ok {
-			return nil, fmt.Errorf("Значение %s имеет некорректный формат.\n", v.Name)
+		colType, err := settings.Types.columnType(field.Name, field.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Значение %s имеет некорректный формат: %s", field.Name, err)
 		}
-
-		ValType := fmt.Sprintf("%s", strings.Title(valTypeStr))
-		fieldsType[i] = ColumnsType{ColName: v.Name, ColType: ValType}
+		fieldsType[i] = ColumnsType{ColName: field.Name, ColType: colType}
 	}
 
 	return fieldsType, nil
 }
 
 // CreateRecordData преобразовывает данные для записи в БД.
-func CreateRecordData(topic string, value []byte) (DataRecord, error) {
-	var err error
-
-	_, err = checkTopic(topic)
+// Одно сообщение может содержать несколько строк, для каждой строки возвращается отдельная запись.
+func CreateRecordData(topic string, value []byte, received time.Time) ([]DataRecord, error) {
+	_, err := checkTopic(topic)
 	if err != nil {
-		return nil, err
+		return nil, parseError(ReasonTopic, err)
 	}
 
 	recordData := make(DataRecord)
 	err = recordData.getDataFromTopic(topic)
 	if err != nil {
-		return nil, err
+		return nil, parseError(ReasonTopic, err)
 	}
-	err = recordData.getDataFromMessage(value)
+
+	records, err := recordData.getDataFromMessage(topic, value, received, settings.forTopic(topic))
 	if err != nil {
-		return nil, err
+		return nil, parseError(ReasonPayload, err)
 	}
 
-	return recordData, nil
+	return records, nil
 }
@@ -1,8 +1,10 @@
 package message
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCheckTopic(t *testing.T) {
@@ -41,7 +43,7 @@ func TestGetDataFromTopic(t *testing.T) {
 
 	testVariants := []*testVariant{
 		{topic: "/balalaykajazz/plants1/out/sensors/temp_out"},
-		{topic: "/balalaykajazz/plants1/temp_out"},
+		{topic: "/balalaykajazz/plants1/out/temp_out"},
 	}
 
 	for _, v := range testVariants {
@@ -50,6 +52,7 @@ func TestGetDataFromTopic(t *testing.T) {
 
 		if err != nil {
 			t.Errorf("Ошибка при получении полей для записи в БД из топика %s", v.topic)
+			continue
 		}
 
 		tableName, _ := recordData["tableName"]
@@ -70,6 +73,7 @@ func TestGetDataFromTopic(t *testing.T) {
 
 		if len(fields) != 2 {
 			t.Errorf("Поле fields должно быть заполнено двумя значениями, а заполнено %v", len(fields))
+			continue
 		}
 
 		if !(fields[0].Name == "client" && fields[0].Value == "balalaykajazz") {
@@ -83,17 +87,21 @@ func TestGetDataFromTopic(t *testing.T) {
 		}
 
 	}
+
+	if err := recordData.getDataFromTopic("/balalaykajazz/plants1/temp_out"); err == nil {
+		t.Errorf("Для топика, который не соответствует шаблону, должна возникать ошибка")
+	}
 }
 
 func TestGetDataFromMessage(t *testing.T) {
-	recordData := make(DataRecord)
-	recordData["fields"] = []Pair{}
+	topicData := DataRecord{"tableName": "temp_out", "fields": []Pair{}}
 	message := `{"timestamp":"2021-11-24T20:27:23Z","value":27.8}`
 
-	err := recordData.getDataFromMessage([]byte(message))
-	if err != nil {
-		t.Errorf("Ошибка при получении полей для записи в БД из сообщения %s", message)
+	records, err := topicData.getDataFromMessage("", []byte(message), time.Now(), TopicSettings{})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Ошибка при получении полей для записи в БД из сообщения %s", message)
 	}
+	recordData := records[0]
 
 	fieldsInterface, ok := recordData["fields"]
 	if !ok {
@@ -111,10 +119,143 @@ func TestGetDataFromMessage(t *testing.T) {
 			fields[0].Name, fields[0].Value)
 	}
 
+	timestamp, ok := fields[1].Value.(time.Time)
+	expectedTimestamp := time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)
+	if !(fields[1].Name == "timestamp" && ok && timestamp.Equal(expectedTimestamp)) {
+		t.Errorf("Поле 'timestamp' должно быть заполнено временем из сообщения. Name %s, value %v",
+			fields[1].Name, fields[1].Value)
+	}
+
 	_, ok = recordData["fieldsType"]
 	if !ok {
 		t.Errorf("Отсутствует поле 'fieldsType'")
 	}
+
+	received := time.Date(2021, 11, 25, 10, 0, 0, 0, time.UTC)
+	records, err = topicData.getDataFromMessage("", []byte(`{"value":27.8}`), received, TopicSettings{})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Ошибка при получении полей для записи в БД из сообщения без времени")
+	}
+
+	fields, _ = records[0]["fields"].([]Pair)
+	if len(fields) != 2 || fields[1].Value != received {
+		t.Errorf("При отсутствии времени в сообщении должно использоваться время получения: %v", fields)
+	}
+
+	_, err = topicData.getDataFromMessage("", []byte(`{"timestamp":"yesterday","value":27.8}`), received, TopicSettings{})
+	if err == nil {
+		t.Errorf("Для некорректного времени в сообщении должна возникать ошибка")
+	}
+}
+
+func TestGetDataFromMessageFields(t *testing.T) {
+	message := `{"temp":21.5,"hum":40,"pressure":1013,"status":"ok","online":true,"raw":[1,2]}`
+
+	type testVariant struct {
+		settings TopicSettings
+		names    []string
+	}
+
+	testVariants := []*testVariant{
+		{settings: TopicSettings{}, names: []string{"hum", "online", "pressure", "raw", "status", "temp", "timestamp"}},
+		{settings: TopicSettings{Include: []string{"temp", "hum"}}, names: []string{"hum", "temp", "timestamp"}},
+		{settings: TopicSettings{Exclude: []string{"status", "online", "raw"}},
+			names: []string{"hum", "pressure", "temp", "timestamp"}},
+	}
+
+	for i, v := range testVariants {
+		topicData := DataRecord{"tableName": "temp_out", "fields": []Pair{}}
+		records, err := topicData.getDataFromMessage("", []byte(message), time.Now(), v.settings)
+		if err != nil || len(records) != 1 {
+			t.Errorf("№%v. Ошибка при получении полей из сообщения: %s", i, err)
+			continue
+		}
+
+		fields, _ := records[0]["fields"].([]Pair)
+		names := make([]string, 0, len(fields))
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+
+		if !reflect.DeepEqual(names, v.names) {
+			t.Errorf("№%v. Поля записи. Ожидание: %v, факт: %v", i, v.names, names)
+		}
+	}
+
+	topicData := DataRecord{"tableName": "temp_out", "fields": []Pair{}}
+	_, err := topicData.getDataFromMessage("", []byte(message), time.Now(), TopicSettings{Include: []string{"unknown"}})
+	if err == nil {
+		t.Errorf("При отсутствии полей для записи должна возникать ошибка")
+	}
+
+	topicData = DataRecord{"tableName": "temp_out", "fields": []Pair{{Name: "device", Value: "plants1"}}}
+	_, err = topicData.getDataFromMessage("", []byte(`{"device":"other","value":1}`), time.Now(), TopicSettings{})
+	if err == nil {
+		t.Errorf("При повторе названия поля должна возникать ошибка")
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	type testVariant struct {
+		filter string
+		topic  string
+		result bool
+	}
+
+	testVariants := []*testVariant{
+		{filter: "/balalaykajazz/plants1/out/sensors/temp_out", topic: "/balalaykajazz/plants1/out/sensors/temp_out",
+			result: true},
+		{filter: "/+/+/out/sensors/+", topic: "/balalaykajazz/plants1/out/sensors/temp_out", result: true},
+		{filter: "/balalaykajazz/#", topic: "/balalaykajazz/plants1/out/sensors/temp_out", result: true},
+		{filter: "#", topic: "/balalaykajazz/plants1/out/sensors/temp_out", result: true},
+		{filter: "/+/+/out/+", topic: "/balalaykajazz/plants1/out/sensors/temp_out", result: false},
+		{filter: "/+/+/in/sensors/+", topic: "/balalaykajazz/plants1/out/sensors/temp_out", result: false},
+		{filter: "/+/+/out/sensors/temp_out/+", topic: "/balalaykajazz/plants1/out/sensors/temp_out",
+			result: false},
+	}
+
+	for i, v := range testVariants {
+		if matchFilter(v.filter, v.topic) != v.result {
+			t.Errorf("№%v. Фильтр %s, топик %s. Ожидание: %v", i, v.filter, v.topic, v.result)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)
+
+	type testVariant struct {
+		value  interface{}
+		result time.Time
+		isErr  bool
+	}
+
+	testVariants := []*testVariant{
+		{value: float64(1637785643), result: expected},
+		{value: float64(1637785643000), result: expected},
+		{value: float64(1637785643000000), result: expected},
+		{value: "1637785643", result: expected},
+		{value: json.Number("1637785643123456789"), result: expected.Add(123456789)},
+		{value: json.Number("1637785643123456"), result: expected.Add(123456 * time.Microsecond)},
+		{value: int64(1637785643123456789), result: expected.Add(123456789)},
+		{value: "1637785643123456789", result: expected.Add(123456789)},
+		{value: json.Number("1637785643.5"), result: expected.Add(500 * time.Millisecond)},
+		{value: "2021-11-24T20:27:23Z", result: expected},
+		{value: "2021-11-24T23:27:23+03:00", result: expected},
+		{value: "2021-11-24T20:27:23.5Z", result: expected.Add(500 * time.Millisecond)},
+		{value: "24.11.2021", isErr: true},
+		{value: true, isErr: true},
+	}
+
+	for i, v := range testVariants {
+		result, err := ParseTimestamp(v.value)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+		}
+		if !v.isErr && !result.Equal(v.result) {
+			t.Errorf("№%v. Ожидание: %v, факт: %v", i, v.result, result)
+		}
+	}
 }
 
 func TestCreateColumnDesc(t *testing.T) {
@@ -124,7 +265,7 @@ func TestCreateColumnDesc(t *testing.T) {
 		{Name: "value", Value: 27.8},
 	}
 
-	columns, err := createColumnDesc(fields)
+	columns, err := createColumnDesc(fields, nil)
 	if err != nil {
 		t.Errorf("Для среза %v не должно возникать ошибки", fields)
 	}
@@ -150,11 +291,12 @@ func TestCreateRecordData(t *testing.T) {
 	topic := "/balalaykajazz/plants1/out/sensors/temp_out"
 	message := `{"timestamp":"2021-11-24T20:27:23Z","value":27.8}`
 
-	recordData, err := CreateRecordData(topic, []byte(message))
+	records, err := CreateRecordData(topic, []byte(message), time.Now())
 
-	if err != nil {
-		t.Errorf("Для топика %s и сообщения %s не должна возвращаться ошибка", topic, message)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Для топика %s и сообщения %s должна возвращаться одна запись без ошибки", topic, message)
 	}
+	recordData := records[0]
 
 	var ok bool
 
@@ -177,7 +319,8 @@ func TestCreateRecordData(t *testing.T) {
 		valueExpected := []Pair{
 			{"client", "balalaykajazz"},
 			{"device", "plants1"},
-			{"value", 27.8}}
+			{"value", 27.8},
+			{"timestamp", time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)}}
 
 		if !success || !reflect.DeepEqual(value, valueExpected) {
 			t.Errorf("Поле 'fields' не соответствует ожидаемому: %v != %v", value, valueExpected)
@@ -192,7 +335,8 @@ func TestCreateRecordData(t *testing.T) {
 		valueExpected := []ColumnsType{
 			{"client", "String"},
 			{"device", "String"},
-			{"value", "Float64"}}
+			{"value", "Float64"},
+			{"timestamp", "DateTime64(3)"}}
 		if !success || !reflect.DeepEqual(value, valueExpected) {
 			t.Errorf("Поле 'fieldsType' не соответствует ожидаемому: %v != %v", value, valueExpected)
 		}
@@ -204,6 +348,36 @@ func BenchmarkCreateRecordData(b *testing.B) {
 	message := `{"timestamp":"2021-11-24T20:27:23Z","value":27.8}`
 
 	for i := 0; i < b.N; i++ {
-		_, _ = CreateRecordData(topic, []byte(message))
+		_, _ = CreateRecordData(topic, []byte(message), time.Now())
+	}
+}
+
+func TestCreateRecordDataReason(t *testing.T) {
+	type testVariant struct {
+		topic   string
+		message string
+		reason  string
+	}
+
+	testVariants := []*testVariant{
+		{topic: "balalaykajazz/plants1/temp_out", message: `{"value":27.8}`, reason: ReasonTopic},
+		{topic: "/balalaykajazz/plants1/out/sensors/temp_out", message: `{"value":`, reason: ReasonPayload},
+		{topic: "/balalaykajazz/plants1/out/sensors/temp_out", message: `{"timestamp":"-","value":27.8}`,
+			reason: ReasonTimestamp},
+		{topic: "/balalaykajazz/plants1/out/sensors/temp_out", message: `{}`, reason: ReasonPayload},
+		{topic: "/balalaykajazz/plants1/out/sensors/temp_out", message: `{"value":1} {}`, reason: ReasonPayload},
+	}
+
+	for i, v := range testVariants {
+		_, err := CreateRecordData(v.topic, []byte(v.message), time.Now())
+
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("№%v. Должна возвращаться ошибка ParseError, а вернулась %v", i, err)
+			continue
+		}
+		if parseErr.Reason != v.reason {
+			t.Errorf("№%v. Причина ошибки. Ожидание: %s, факт: %s", i, v.reason, parseErr.Reason)
+		}
 	}
 }
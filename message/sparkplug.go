@@ -0,0 +1,451 @@
+package message
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sparkplugNamespace первый уровень топиков Sparkplug B.
+const sparkplugNamespace = "spBv1.0"
+
+// Типы сообщений Sparkplug B.
+const (
+	sparkplugNodeBirth   = "NBIRTH"
+	sparkplugNodeDeath   = "NDEATH"
+	sparkplugNodeData    = "NDATA"
+	sparkplugNodeCommand = "NCMD"
+	sparkplugDevBirth    = "DBIRTH"
+	sparkplugDevDeath    = "DDEATH"
+	sparkplugDevData     = "DDATA"
+	sparkplugDevCommand  = "DCMD"
+)
+
+// Типы данных метрик Sparkplug B.
+const (
+	sparkplugInt8     = 1
+	sparkplugInt16    = 2
+	sparkplugInt32    = 3
+	sparkplugInt64    = 4
+	sparkplugUInt8    = 5
+	sparkplugUInt16   = 6
+	sparkplugUInt32   = 7
+	sparkplugUInt64   = 8
+	sparkplugFloat    = 9
+	sparkplugDouble   = 10
+	sparkplugBoolean  = 11
+	sparkplugString   = 12
+	sparkplugDateTime = 13
+	sparkplugText     = 14
+	sparkplugUUID     = 15
+)
+
+// Колонки строк, полученных из метрик Sparkplug B.
+const (
+	sparkplugDeviceColumn = "device"
+	sparkplugMetricColumn = "metric"
+	sparkplugIntColumn    = "value_int"
+	sparkplugUIntColumn   = "value_uint"
+	sparkplugFloatColumn  = "value_float"
+	sparkplugBoolColumn   = "value_bool"
+	sparkplugStringColumn = "value_string"
+)
+
+// sparkplugDecoder разбирает сообщения Sparkplug B в формате protobuf.
+// Каждая метрика сообщения становится отдельной строкой с колонками device, metric и value_int, value_uint,
+// value_float, value_bool, value_string: значение записывается в колонку своего типа, остальные равны null.
+// Колонка device есть в строках узлов и устройств (для узла пустая строка), поэтому сообщения узлов
+// и устройств можно записывать в одну таблицу. Шаблон топика не должен содержать поле {device},
+// для топиков узлов и устройств подходит шаблон spBv1.0/{group}/+/{node}/#.
+// Время DateTime записывается в value_int в миллисекундах. Метрики DataSet, Template, Bytes, File
+// и массивы пропускаются.
+// Декодер хранит состояние узлов: алиасы метрик из NBIRTH и DBIRTH и признак подключения
+// из BIRTH и DEATH. Данные от отключенного узла или устройства не принимаются.
+type sparkplugDecoder struct {
+	mu    *sync.Mutex
+	nodes map[string]*sparkplugNode
+}
+
+// sparkplugNode состояние узла Sparkplug B. bdSeq - номер сессии из NBIRTH для проверки NDEATH.
+type sparkplugNode struct {
+	sparkplugEdge
+	bdSeq    uint64
+	hasBdSeq bool
+	devices  map[string]*sparkplugEdge
+}
+
+// sparkplugEdge состояние узла или устройства: признак подключения и описания метрик по алиасам.
+type sparkplugEdge struct {
+	online  bool
+	aliases map[uint64]sparkplugAlias
+}
+
+// sparkplugAlias описание метрики из сообщения BIRTH.
+type sparkplugAlias struct {
+	name     string
+	datatype uint64
+}
+
+// sparkplugPayload сообщение Sparkplug B.
+type sparkplugPayload struct {
+	timestamp uint64
+	metrics   []sparkplugMetric
+}
+
+// sparkplugMetric метрика сообщения Sparkplug B. value - поле protobuf со значением метрики.
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64
+	datatype  uint64
+	isNull    bool
+	value     protoField
+}
+
+// protoField поле сообщения protobuf. Числовые значения хранятся в varint, строки и вложенные сообщения в bytes.
+type protoField struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+// makeSparkplugDecoder возвращает декодер Sparkplug B без известных узлов.
+func makeSparkplugDecoder() *sparkplugDecoder {
+	return &sparkplugDecoder{
+		mu:    &sync.Mutex{},
+		nodes: make(map[string]*sparkplugNode),
+	}
+}
+
+// Decode возвращает ошибку, так как для разбора сообщения Sparkplug B нужен топик.
+func (s *sparkplugDecoder) Decode(payload []byte) ([]Row, error) {
+	return nil, fmt.Errorf("Для разбора сообщения Sparkplug B нужен топик\n")
+}
+
+// DecodeTopic разбирает сообщение из топика spBv1.0/<group>/<type>/<node>[/<device>].
+// Сообщения DEATH и команды обновляют состояние узлов и не содержат строк для записи.
+func (s *sparkplugDecoder) DecodeTopic(topic string, payload []byte) ([]Row, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != sparkplugNamespace {
+		return nil, fmt.Errorf("Топик %s не соответствует формату Sparkplug B\n", topic)
+	}
+	messageType := levels[2]
+	nodeKey := levels[1] + "/" + levels[3]
+
+	deviceMessage := strings.HasPrefix(messageType, "D")
+	if deviceMessage != (len(levels) == 5) {
+		return nil, fmt.Errorf("Топик %s не соответствует типу сообщения %s\n", topic, messageType)
+	}
+	device := ""
+	if deviceMessage {
+		device = levels[4]
+	}
+
+	p, err := parseSparkplugPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.nodes[nodeKey]
+
+	switch messageType {
+	case sparkplugNodeBirth:
+		node = &sparkplugNode{
+			sparkplugEdge: sparkplugEdge{online: true, aliases: make(map[uint64]sparkplugAlias)},
+			devices:       make(map[string]*sparkplugEdge),
+		}
+		for _, metric := range p.metrics {
+			if metric.name == "bdSeq" {
+				node.bdSeq, node.hasBdSeq = metric.value.varint, true
+			}
+		}
+		s.nodes[nodeKey] = node
+		return p.rows(&node.sparkplugEdge, true, device)
+
+	case sparkplugNodeDeath:
+		if node == nil || !node.online {
+			return nil, nil
+		}
+		for _, metric := range p.metrics {
+			if metric.name == "bdSeq" && node.hasBdSeq && metric.value.varint != node.bdSeq {
+				// NDEATH предыдущей сессии узла, текущая сессия остается активной.
+				return nil, nil
+			}
+		}
+		node.online = false
+		for _, dev := range node.devices {
+			dev.online = false
+		}
+		return nil, nil
+
+	case sparkplugNodeData:
+		if node == nil {
+			return p.rows(&sparkplugEdge{}, false, device)
+		}
+		if !node.online {
+			return nil, fmt.Errorf("Узел %s не в сети, ожидается NBIRTH\n", nodeKey)
+		}
+		return p.rows(&node.sparkplugEdge, false, device)
+
+	case sparkplugDevBirth:
+		if node == nil {
+			node = &sparkplugNode{devices: make(map[string]*sparkplugEdge)}
+			node.online = true
+			s.nodes[nodeKey] = node
+		}
+		if !node.online {
+			return nil, fmt.Errorf("Узел %s не в сети, ожидается NBIRTH\n", nodeKey)
+		}
+		dev := &sparkplugEdge{online: true, aliases: make(map[uint64]sparkplugAlias)}
+		node.devices[device] = dev
+		return p.rows(dev, true, device)
+
+	case sparkplugDevDeath:
+		if dev, ok := node.device(device); ok {
+			dev.online = false
+		}
+		return nil, nil
+
+	case sparkplugDevData:
+		if node != nil && !node.online {
+			return nil, fmt.Errorf("Узел %s не в сети, ожидается NBIRTH\n", nodeKey)
+		}
+		dev, ok := node.device(device)
+		if !ok {
+			return p.rows(&sparkplugEdge{}, false, device)
+		}
+		if !dev.online {
+			return nil, fmt.Errorf("Устройство %s/%s не в сети, ожидается DBIRTH\n", nodeKey, device)
+		}
+		return p.rows(dev, false, device)
+
+	case sparkplugNodeCommand, sparkplugDevCommand:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Неизвестный тип сообщения Sparkplug B %s\n", messageType)
+}
+
+// device возвращает состояние устройства узла.
+func (n *sparkplugNode) device(name string) (*sparkplugEdge, bool) {
+	if n == nil {
+		return nil, false
+	}
+	dev, ok := n.devices[name]
+	return dev, ok
+}
+
+// rows преобразовывает метрики сообщения устройства device (для узла пустая строка) в строки для записи.
+// Если birth, алиасы метрик сохраняются в edge, иначе названия и типы метрик с алиасами берутся из edge.
+func (p sparkplugPayload) rows(edge *sparkplugEdge, birth bool, device string) ([]Row, error) {
+	types := map[string]string{
+		sparkplugDeviceColumn: tagColumnType,
+		sparkplugMetricColumn: tagColumnType,
+		sparkplugIntColumn:    "Nullable(Int64)",
+		sparkplugUIntColumn:   "Nullable(UInt64)",
+		sparkplugFloatColumn:  "Nullable(Float64)",
+		sparkplugBoolColumn:   fmt.Sprintf("Nullable(%s)", settings.Types.Bool),
+		sparkplugStringColumn: "Nullable(String)",
+	}
+
+	rows := make([]Row, 0, len(p.metrics))
+	for _, metric := range p.metrics {
+		if metric.hasAlias {
+			if birth {
+				edge.aliases[metric.alias] = sparkplugAlias{name: metric.name, datatype: metric.datatype}
+			} else if alias, ok := edge.aliases[metric.alias]; ok {
+				if metric.name == "" {
+					metric.name = alias.name
+				}
+				if metric.datatype == 0 {
+					metric.datatype = alias.datatype
+				}
+			}
+		}
+		if metric.name == "" {
+			return nil, fmt.Errorf("Алиас метрики %v не описан в сообщении BIRTH\n", metric.alias)
+		}
+
+		column, value, ok, err := metric.columnValue()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		row := Row{
+			Fields: map[string]interface{}{
+				sparkplugDeviceColumn: device,
+				sparkplugMetricColumn: metric.name,
+				sparkplugIntColumn:    nil,
+				sparkplugUIntColumn:   nil,
+				sparkplugFloatColumn:  nil,
+				sparkplugBoolColumn:   nil,
+				sparkplugStringColumn: nil,
+			},
+			Types: types,
+		}
+		row.Fields[column] = value
+
+		timestamp := metric.timestamp
+		if timestamp == 0 {
+			timestamp = p.timestamp
+		}
+		if timestamp != 0 {
+			row.Time = time.Unix(0, int64(timestamp)*int64(time.Millisecond)).UTC()
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// columnValue возвращает колонку и значение метрики. Если тип метрики не поддерживается, ok равно false.
+func (m sparkplugMetric) columnValue() (column string, value interface{}, ok bool, err error) {
+	var field protowire.Number
+	switch m.datatype {
+	case sparkplugInt8, sparkplugInt16, sparkplugInt32, sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		column, field = sparkplugIntColumn, 10
+	case sparkplugInt64, sparkplugDateTime:
+		column, field = sparkplugIntColumn, 11
+	case sparkplugUInt64:
+		column, field = sparkplugUIntColumn, 11
+	case sparkplugFloat:
+		column, field = sparkplugFloatColumn, 12
+	case sparkplugDouble:
+		column, field = sparkplugFloatColumn, 13
+	case sparkplugBoolean:
+		column, field = sparkplugBoolColumn, 14
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		column, field = sparkplugStringColumn, 15
+	case 0:
+		return "", nil, false, fmt.Errorf("Не указан тип метрики %s\n", m.name)
+	default:
+		return "", nil, false, nil
+	}
+
+	if m.isNull {
+		return column, nil, true, nil
+	}
+	if m.value.num != field {
+		return "", nil, false, fmt.Errorf("Значение метрики %s не соответствует ее типу\n", m.name)
+	}
+
+	v := m.value.varint
+	switch m.datatype {
+	case sparkplugInt8:
+		value = int64(int8(v))
+	case sparkplugInt16:
+		value = int64(int16(v))
+	case sparkplugInt32:
+		value = int64(int32(v))
+	case sparkplugInt64, sparkplugDateTime, sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		value = int64(v)
+	case sparkplugUInt64:
+		value = v
+	case sparkplugFloat:
+		value = float64(math.Float32frombits(uint32(v)))
+	case sparkplugDouble:
+		value = math.Float64frombits(v)
+	case sparkplugBoolean:
+		value = v != 0
+	default:
+		value = string(m.value.bytes)
+	}
+	return column, value, true, nil
+}
+
+// parseSparkplugPayload разбирает сообщение Sparkplug B.
+func parseSparkplugPayload(payload []byte) (sparkplugPayload, error) {
+	var p sparkplugPayload
+
+	fields, err := parseProtoFields(payload)
+	if err != nil {
+		return p, err
+	}
+
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			p.timestamp = field.varint
+		case 2:
+			metric, err := parseSparkplugMetric(field.bytes)
+			if err != nil {
+				return p, err
+			}
+			p.metrics = append(p.metrics, metric)
+		}
+	}
+	return p, nil
+}
+
+// parseSparkplugMetric разбирает метрику сообщения Sparkplug B.
+func parseSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+
+	fields, err := parseProtoFields(b)
+	if err != nil {
+		return m, err
+	}
+
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			m.name = string(field.bytes)
+		case 2:
+			m.alias, m.hasAlias = field.varint, true
+		case 3:
+			m.timestamp = field.varint
+		case 4:
+			m.datatype = field.varint
+		case 7:
+			m.isNull = field.varint != 0
+		case 10, 11, 12, 13, 14, 15:
+			m.value = field
+		}
+	}
+	return m, nil
+}
+
+// parseProtoFields разбирает поля сообщения protobuf верхнего уровня.
+func parseProtoFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("Некорректное сообщение protobuf: %s\n", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		field := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			field.varint = uint64(v)
+		case protowire.Fixed64Type:
+			field.varint, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("Некорректное сообщение protobuf: %s\n", protowire.ParseError(n))
+		}
+
+		fields = append(fields, field)
+		b = b[n:]
+	}
+	return fields, nil
+}
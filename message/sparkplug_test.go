@@ -0,0 +1,241 @@
+package message
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testMetric описание метрики для формирования тестового сообщения Sparkplug B.
+type testMetric struct {
+	name     string
+	alias    uint64
+	datatype uint64
+	field    protowire.Number
+	value    uint64
+	text     string
+}
+
+// sparkplugPayloadBytes формирует сообщение Sparkplug B в формате protobuf.
+func sparkplugPayloadBytes(timestamp uint64, metrics ...testMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+
+	for _, metric := range metrics {
+		var m []byte
+		if metric.name != "" {
+			m = protowire.AppendTag(m, 1, protowire.BytesType)
+			m = protowire.AppendString(m, metric.name)
+		}
+		if metric.alias != 0 {
+			m = protowire.AppendTag(m, 2, protowire.VarintType)
+			m = protowire.AppendVarint(m, metric.alias)
+		}
+		if metric.datatype != 0 {
+			m = protowire.AppendTag(m, 4, protowire.VarintType)
+			m = protowire.AppendVarint(m, metric.datatype)
+		}
+		switch metric.field {
+		case 12:
+			m = protowire.AppendTag(m, 12, protowire.Fixed32Type)
+			m = protowire.AppendFixed32(m, uint32(metric.value))
+		case 13:
+			m = protowire.AppendTag(m, 13, protowire.Fixed64Type)
+			m = protowire.AppendFixed64(m, metric.value)
+		case 15:
+			m = protowire.AppendTag(m, 15, protowire.BytesType)
+			m = protowire.AppendString(m, metric.text)
+		default:
+			m = protowire.AppendTag(m, metric.field, protowire.VarintType)
+			m = protowire.AppendVarint(m, metric.value)
+		}
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b
+}
+
+func TestSparkplugDecoder(t *testing.T) {
+	decoder := makeSparkplugDecoder()
+
+	birth := sparkplugPayloadBytes(1650000000000,
+		testMetric{name: "bdSeq", datatype: sparkplugInt64, field: 11, value: 3},
+		testMetric{name: "Temperature", alias: 1, datatype: sparkplugFloat, field: 12,
+			value: uint64(math.Float32bits(21.5))},
+		testMetric{name: "Offset", alias: 2, datatype: sparkplugInt16, field: 10, value: uint64(0xFFFF)},
+		testMetric{name: "Running", alias: 3, datatype: sparkplugBoolean, field: 14, value: 1},
+		testMetric{name: "Serial", alias: 4, datatype: sparkplugString, field: 15, text: "A-17"},
+	)
+	rows, err := decoder.DecodeTopic("spBv1.0/plant/DBIRTH/gw1/pump", birth)
+	if err != nil {
+		t.Fatalf("Ошибка разбора DBIRTH: %s", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("DBIRTH должно содержать 5 строк, а содержит %v", len(rows))
+	}
+
+	data := sparkplugPayloadBytes(1650000001000,
+		testMetric{alias: 1, field: 12, value: uint64(math.Float32bits(22.25))},
+		testMetric{alias: 2, field: 10, value: uint64(0xFFFE)},
+	)
+	rows, err = decoder.DecodeTopic("spBv1.0/plant/DDATA/gw1/pump", data)
+	if err != nil {
+		t.Fatalf("Ошибка разбора DDATA: %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("DDATA должно содержать 2 строки, а содержит %v", len(rows))
+	}
+
+	expected := map[string]interface{}{
+		sparkplugDeviceColumn: "pump",
+		sparkplugMetricColumn: "Offset",
+		sparkplugIntColumn:    int64(-2),
+		sparkplugUIntColumn:   nil,
+		sparkplugFloatColumn:  nil,
+		sparkplugBoolColumn:   nil,
+		sparkplugStringColumn: nil,
+	}
+	if !reflect.DeepEqual(rows[1].Fields, expected) {
+		t.Errorf("Ожидание: %v, факт: %v", expected, rows[1].Fields)
+	}
+	if rows[0].Fields[sparkplugFloatColumn] != 22.25 {
+		t.Errorf("Некорректное значение метрики Temperature: %v", rows[0].Fields)
+	}
+	if !rows[0].Time.Equal(time.Unix(1650000001, 0)) {
+		t.Errorf("Некорректное время метрики: %v", rows[0].Time)
+	}
+
+	unknown := sparkplugPayloadBytes(1650000001000, testMetric{alias: 9, field: 10, value: 1})
+	if _, err = decoder.DecodeTopic("spBv1.0/plant/DDATA/gw1/pump", unknown); err == nil {
+		t.Errorf("Для неизвестного алиаса должна быть ошибка")
+	}
+
+	rows, err = decoder.DecodeTopic("spBv1.0/plant/DDEATH/gw1/pump", sparkplugPayloadBytes(1650000002000))
+	if err != nil || len(rows) != 0 {
+		t.Errorf("DDEATH не должно содержать строк: %v, %v", rows, err)
+	}
+	if _, err = decoder.DecodeTopic("spBv1.0/plant/DDATA/gw1/pump", data); err == nil {
+		t.Errorf("Для отключенного устройства должна быть ошибка")
+	}
+}
+
+func TestSparkplugNodeState(t *testing.T) {
+	decoder := makeSparkplugDecoder()
+	topic := "spBv1.0/plant/%s/gw1"
+	bdSeq := func(seq uint64) []byte {
+		return sparkplugPayloadBytes(1650000000000,
+			testMetric{name: "bdSeq", datatype: sparkplugInt64, field: 11, value: seq})
+	}
+	data := sparkplugPayloadBytes(1650000000000,
+		testMetric{name: "Counter", datatype: sparkplugUInt64, field: 11, value: 7})
+
+	type testVariant struct {
+		messageType string
+		payload     []byte
+		rows        int
+		err         bool
+	}
+
+	testVariants := []testVariant{
+		{sparkplugNodeData, data, 1, false},
+		{sparkplugNodeBirth, bdSeq(1), 1, false},
+		{sparkplugNodeDeath, bdSeq(0), 0, false},
+		{sparkplugNodeData, data, 1, false},
+		{sparkplugNodeDeath, bdSeq(1), 0, false},
+		{sparkplugNodeData, data, 0, true},
+		{sparkplugNodeCommand, data, 0, false},
+		{sparkplugNodeBirth, bdSeq(2), 1, false},
+		{sparkplugNodeData, data, 1, false},
+		{"STATE", data, 0, true},
+	}
+
+	for i, v := range testVariants {
+		rows, err := decoder.DecodeTopic(fmt.Sprintf(topic, v.messageType), v.payload)
+		if (err != nil) != v.err || len(rows) != v.rows {
+			t.Errorf("Шаг %v %s: ожидание %v строк и ошибка %v, факт: %v строк, ошибка %v",
+				i, v.messageType, v.rows, v.err, len(rows), err)
+		}
+	}
+}
+
+func TestSparkplugRecords(t *testing.T) {
+	s := DefaultSettings()
+	s.Topics = []TopicSettings{{
+		Filter:    "spBv1.0/#",
+		Table:     "sparkplug",
+		Templates: []string{"spBv1.0/{group}/+/{node}/#"},
+		Payload:   &PayloadSettings{Format: FormatSparkplug},
+	}}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка настройки: %s", err)
+	}
+	defer Configure(DefaultSettings())
+
+	payload := sparkplugPayloadBytes(1650000000000,
+		testMetric{name: "Counter", datatype: sparkplugUInt64, field: 11, value: 7})
+	records, err := CreateRecordData("spBv1.0/plant/NDATA/gw1", payload, time.Now())
+	if err != nil {
+		t.Fatalf("Ошибка формирования записей: %s", err)
+	}
+	if len(records) != 1 || records[0]["tableName"] != "sparkplug" {
+		t.Fatalf("Некорректные записи: %v", records)
+	}
+
+	expected := []ColumnsType{
+		{"group", "String"},
+		{"node", "String"},
+		{sparkplugDeviceColumn, tagColumnType},
+		{sparkplugMetricColumn, tagColumnType},
+		{sparkplugBoolColumn, "Nullable(UInt8)"},
+		{sparkplugFloatColumn, "Nullable(Float64)"},
+		{sparkplugIntColumn, "Nullable(Int64)"},
+		{sparkplugStringColumn, "Nullable(String)"},
+		{sparkplugUIntColumn, "Nullable(UInt64)"},
+		{timestampColumn, "DateTime64(3)"},
+	}
+	if !reflect.DeepEqual(records[0]["fieldsType"], expected) {
+		t.Errorf("Ожидание: %v, факт: %v", expected, records[0]["fieldsType"])
+	}
+
+	records, err = CreateRecordData("spBv1.0/plant/NDEATH/gw1", payload, time.Now())
+	if err != nil || len(records) != 0 {
+		t.Errorf("NDEATH не должно содержать записей: %v, %v", records, err)
+	}
+}
+
+func TestSparkplugNodeAndDeviceColumns(t *testing.T) {
+	s := DefaultSettings()
+	s.Topics = []TopicSettings{{
+		Filter:    "spBv1.0/#",
+		Table:     "sparkplug",
+		Templates: []string{"spBv1.0/{group}/+/{node}/#"},
+		Payload:   &PayloadSettings{Format: FormatSparkplug},
+	}}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка настройки: %s", err)
+	}
+	defer Configure(DefaultSettings())
+
+	metric := testMetric{name: "Counter", datatype: sparkplugUInt64, field: 11, value: 7}
+	steps := []string{"spBv1.0/plant/NBIRTH/gw1", "spBv1.0/plant/DBIRTH/gw1/pump", "spBv1.0/plant/DDATA/gw1/pump"}
+
+	var nodeTypes interface{}
+	for i, topic := range steps {
+		records, err := CreateRecordData(topic, sparkplugPayloadBytes(1650000000000, metric), time.Now())
+		if err != nil || len(records) != 1 {
+			t.Fatalf("Топик %s: %v записей, ошибка %v", topic, len(records), err)
+		}
+		if i == 0 {
+			nodeTypes = records[0]["fieldsType"]
+			continue
+		}
+		if !reflect.DeepEqual(records[0]["fieldsType"], nodeTypes) {
+			t.Errorf("Колонки записей узла и устройства должны совпадать: %v <> %v", nodeTypes, records[0]["fieldsType"])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package message
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultTemplate шаблон топика по умолчанию: '/client/device/../sensorName'.
+const defaultTemplate = "/{client}/{device}/+/#/{table}"
+
+// tableField название поля шаблона, которое определяет таблицу для записи.
+const tableField = "table"
+
+// placeholderRe описывает именованный уровень шаблона, например {device}.
+var placeholderRe = regexp.MustCompile(`^\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// topicTemplate разобранный шаблон топика.
+// Уровни шаблона: {name} - именованный уровень, + - любой один уровень, # - любое количество уровней,
+// остальные уровни должны совпадать с топиком.
+type topicTemplate struct {
+	source string
+	levels []string
+}
+
+// parseTemplate разбирает и проверяет шаблон топика.
+func parseTemplate(source string) (topicTemplate, error) {
+	levels := strings.Split(source, "/")
+
+	names := make(map[string]bool)
+	multiLevel := 0
+	for _, level := range levels {
+		if level == "#" {
+			multiLevel++
+			continue
+		}
+		if !strings.ContainsAny(level, "{}") {
+			continue
+		}
+
+		tokens := placeholderRe.FindStringSubmatch(level)
+		if tokens == nil {
+			return topicTemplate{}, fmt.Errorf("Уровень '%s' шаблона '%s' имеет некорректный формат\n", level, source)
+		}
+		if names[tokens[1]] {
+			return topicTemplate{}, fmt.Errorf("Поле '%s' встречается в шаблоне '%s' несколько раз\n", tokens[1], source)
+		}
+		names[tokens[1]] = true
+	}
+
+	if multiLevel > 1 {
+		return topicTemplate{}, fmt.Errorf("Шаблон '%s' может содержать только один уровень '#'\n", source)
+	}
+
+	return topicTemplate{source: source, levels: levels}, nil
+}
+
+// parseTemplates разбирает список шаблонов топиков.
+func parseTemplates(sources []string) ([]topicTemplate, error) {
+	templates := make([]topicTemplate, 0, len(sources))
+	for _, source := range sources {
+		template, err := parseTemplate(source)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+// match сопоставляет топик с шаблоном и возвращает значения именованных уровней в порядке шаблона.
+func (t topicTemplate) match(topic string) ([]Pair, bool) {
+	topicLevels := strings.Split(topic, "/")
+
+	multiLevel := -1
+	for i, level := range t.levels {
+		if level == "#" {
+			multiLevel = i
+		}
+	}
+
+	// Уровень '#' занимает все уровни топика, не занятые остальными уровнями шаблона.
+	var aligned []string
+	if multiLevel < 0 {
+		if len(topicLevels) != len(t.levels) {
+			return nil, false
+		}
+		aligned = topicLevels
+	} else {
+		tail := len(t.levels) - multiLevel - 1
+		if len(topicLevels) < len(t.levels)-1 {
+			return nil, false
+		}
+		aligned = append(aligned, topicLevels[:multiLevel]...)
+		aligned = append(aligned, "")
+		aligned = append(aligned, topicLevels[len(topicLevels)-tail:]...)
+	}
+
+	var fields []Pair
+	for i, level := range t.levels {
+		value := aligned[i]
+		switch {
+		case level == "#" || level == "+":
+			if level == "+" && value == "" {
+				return nil, false
+			}
+		case placeholderRe.MatchString(level):
+			if value == "" {
+				return nil, false
+			}
+			fields = append(fields, Pair{Name: level[1 : len(level)-1], Value: value})
+		case level != value:
+			return nil, false
+		}
+	}
+
+	return fields, true
+}
+
+// matchTemplates сопоставляет топик с шаблонами и возвращает название таблицы и значения остальных полей
+// первого подходящего шаблона. Если шаблон не содержит поле {table}, таблицу определяет формат сообщения.
+func matchTemplates(templates []topicTemplate, topic string) (string, []Pair, error) {
+	sources := make([]string, 0, len(templates))
+	for _, template := range templates {
+		fields, ok := template.match(topic)
+		if !ok {
+			sources = append(sources, template.source)
+			continue
+		}
+
+		var tableName string
+		result := make([]Pair, 0, len(fields))
+		for _, field := range fields {
+			if field.Name == tableField {
+				tableName = field.Value.(string)
+				continue
+			}
+			result = append(result, field)
+		}
+		return tableName, result, nil
+	}
+
+	return "", nil, fmt.Errorf("Топик '%s' не соответствует ни одному шаблону: %s\n",
+		topic, strings.Join(sources, ", "))
+}
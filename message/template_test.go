@@ -0,0 +1,104 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	type testVariant struct {
+		template string
+		isErr    bool
+	}
+
+	testVariants := []*testVariant{
+		{template: defaultTemplate, isErr: false},
+		{template: "{tenant}/{site}/{device}/telemetry/{table}", isErr: false},
+		{template: "{tenant}/{site}/{device}/telemetry", isErr: false},
+		{template: "{device}/{device}/{table}", isErr: true},
+		{template: "{device}/#/#/{table}", isErr: true},
+		{template: "{dev-ice}/{table}", isErr: true},
+		{template: "{device/{table}", isErr: true},
+	}
+
+	for i, v := range testVariants {
+		_, err := parseTemplate(v.template)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Шаблон %s. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.template, v.isErr, err)
+		}
+	}
+}
+
+func TestTemplateMatch(t *testing.T) {
+	type testVariant struct {
+		template string
+		topic    string
+		fields   []Pair
+		result   bool
+	}
+
+	testVariants := []*testVariant{
+		{template: "{tenant}/{site}/{device}/telemetry/{table}", topic: "acme/plant1/pump3/telemetry/pressure",
+			fields: []Pair{{"tenant", "acme"}, {"site", "plant1"}, {"device", "pump3"}, {"table", "pressure"}},
+			result: true},
+		{template: "{tenant}/{site}/{device}/telemetry/{table}", topic: "acme/plant1/pump3/status/pressure",
+			result: false},
+		{template: "{tenant}/{site}/{device}/telemetry/{table}", topic: "acme/plant1/telemetry/pressure",
+			result: false},
+		{template: defaultTemplate, topic: "/balalaykajazz/plants1/out/sensors/temp_out",
+			fields: []Pair{{"client", "balalaykajazz"}, {"device", "plants1"}, {"table", "temp_out"}}, result: true},
+		{template: defaultTemplate, topic: "/balalaykajazz/plants1/out/temp_out",
+			fields: []Pair{{"client", "balalaykajazz"}, {"device", "plants1"}, {"table", "temp_out"}}, result: true},
+		{template: defaultTemplate, topic: "/balalaykajazz/plants1/temp_out", result: false},
+		{template: "{device}/+/{table}", topic: "pump3//pressure", result: false},
+		{template: "{device}/{table}", topic: "/pressure", result: false},
+	}
+
+	for i, v := range testVariants {
+		template, err := parseTemplate(v.template)
+		if err != nil {
+			t.Errorf("№%v. Ошибка разбора шаблона %s: %s", i, v.template, err)
+			continue
+		}
+
+		fields, ok := template.match(v.topic)
+		if ok != v.result {
+			t.Errorf("№%v. Шаблон %s, топик %s. Ожидание: %v", i, v.template, v.topic, v.result)
+		}
+		if ok && !reflect.DeepEqual(fields, v.fields) {
+			t.Errorf("№%v. Поля топика. Ожидание: %v, факт: %v", i, v.fields, fields)
+		}
+	}
+}
+
+func TestTopicTemplates(t *testing.T) {
+	defer func() { _ = Configure(DefaultSettings()) }()
+
+	s := DefaultSettings()
+	s.Topics = []TopicSettings{
+		{Filter: "+/+/+/telemetry/+", Templates: []string{"{tenant}/{site}/{device}/telemetry/{table}"}},
+	}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка применения настроек: %s", err)
+	}
+
+	recordData := make(DataRecord)
+	if err := recordData.getDataFromTopic("acme/plant1/pump3/telemetry/pressure"); err != nil {
+		t.Fatalf("Ошибка при получении полей из топика: %s", err)
+	}
+
+	expected := []Pair{{"tenant", "acme"}, {"site", "plant1"}, {"device", "pump3"}}
+	if recordData["tableName"] != "pressure" || !reflect.DeepEqual(recordData["fields"], expected) {
+		t.Errorf("Поля топика. Ожидание: pressure %v, факт: %v %v", expected,
+			recordData["tableName"], recordData["fields"])
+	}
+
+	if err := recordData.getDataFromTopic("/balalaykajazz/plants1/out/sensors/temp_out"); err != nil {
+		t.Errorf("Для остальных топиков должны использоваться общие шаблоны: %s", err)
+	}
+
+	s.Topics[0].Templates = []string{"{tenant}/{tenant}"}
+	if err := Configure(s); err == nil {
+		t.Errorf("Для некорректного шаблона должна возникать ошибка")
+	}
+}
@@ -0,0 +1,97 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const timestampColumn = "timestamp"
+
+// TimestampSettings описывает заполнение колонки времени записи.
+// Field - поле сообщения со временем, Precision - точность DateTime64 (количество знаков после секунд).
+type TimestampSettings struct {
+	Field     string `json:"field"`
+	Precision int    `json:"precision"`
+}
+
+// validate проверяет корректность настроек времени записи.
+func (t TimestampSettings) validate() error {
+	if t.Precision < 0 || t.Precision > 9 {
+		return fmt.Errorf("Точность DateTime64 должна быть от 0 до 9, указано %v\n", t.Precision)
+	}
+	return nil
+}
+
+// columnType возвращает тип колонки времени записи.
+func (t TimestampSettings) columnType() string {
+	return fmt.Sprintf("DateTime64(%d)", t.Precision)
+}
+
+// ParseTimestamp преобразовывает значение из сообщения во время.
+// Поддерживаются unix время в секундах, миллисекундах, микросекундах, наносекундах и строки RFC3339.
+func ParseTimestamp(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return unixTimeInt(i), nil
+		}
+		if f, err := v.Float64(); err == nil {
+			return unixTime(f), nil
+		}
+	case float64:
+		return unixTime(v), nil
+	case int64:
+		return unixTimeInt(v), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.UTC(), nil
+		}
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return unixTimeInt(i), nil
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return unixTime(f), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Значение времени %v имеет некорректный формат.\n", value)
+}
+
+// unixTime преобразовывает unix время во время. Единица измерения определяется по величине числа.
+func unixTime(value float64) time.Time {
+	var scale float64
+	switch abs := math.Abs(value); {
+	case abs >= 1e17:
+		scale = 1
+	case abs >= 1e14:
+		scale = 1e3
+	case abs >= 1e11:
+		scale = 1e6
+	default:
+		scale = 1e9
+	}
+
+	return time.Unix(0, int64(math.Round(value*scale))).UTC()
+}
+
+// unixTimeInt преобразовывает целое unix время во время без потери точности.
+// Единица измерения определяется по величине числа так же, как в unixTime.
+func unixTimeInt(value int64) time.Time {
+	abs := value
+	if abs < 0 {
+		abs = -abs
+	}
+
+	switch {
+	case abs >= 1e17:
+		return time.Unix(0, value).UTC()
+	case abs >= 1e14:
+		return time.Unix(0, value*1e3).UTC()
+	case abs >= 1e11:
+		return time.Unix(0, value*1e6).UTC()
+	}
+	return time.Unix(value, 0).UTC()
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"strings"
+)
+
+// TopicSettings содержит настройки преобразования сообщений из топиков, подходящих под фильтр Filter.
+// Include - поля сообщения для записи (если не указаны, записываются все поля), Exclude - поля, которые не записываются.
+// Payload, Flatten и Templates заменяют общие настройки формата сообщения, раскрытия вложенных объектов
+// и шаблоны топиков. Table - таблица для записи, если шаблон топика не содержит поле {table}.
+type TopicSettings struct {
+	Filter    string           `json:"filter"`
+	Table     string           `json:"table"`
+	Include   []string         `json:"include"`
+	Exclude   []string         `json:"exclude"`
+	Payload   *PayloadSettings `json:"payload"`
+	Flatten   *FlattenSettings `json:"flatten"`
+	Templates []string         `json:"templates"`
+
+	decoder   Decoder
+	templates []topicTemplate
+}
+
+// forTopic возвращает настройки первого фильтра, под который подходит топик.
+func (s Settings) forTopic(topic string) TopicSettings {
+	for _, topicSettings := range s.Topics {
+		if matchFilter(topicSettings.Filter, topic) {
+			return topicSettings
+		}
+	}
+	return TopicSettings{}
+}
+
+// flattenSettings возвращает настройки раскрытия вложенных объектов для топика.
+func (t TopicSettings) flattenSettings() FlattenSettings {
+	if t.Flatten != nil {
+		return *t.Flatten
+	}
+	return settings.Flatten
+}
+
+// payloadDecoder возвращает декодер тела сообщения для топика.
+func (t TopicSettings) payloadDecoder() Decoder {
+	if t.decoder != nil {
+		return t.decoder
+	}
+	return settings.decoder
+}
+
+// topicTemplates возвращает шаблоны топиков для подписки.
+func (t TopicSettings) topicTemplates() []topicTemplate {
+	if len(t.templates) > 0 {
+		return t.templates
+	}
+	return settings.templates
+}
+
+// allowField проверяет, нужно ли записывать поле сообщения.
+func (t TopicSettings) allowField(name string) bool {
+	if len(t.Include) > 0 && !containsString(t.Include, name) {
+		return false
+	}
+	return !containsString(t.Exclude, name)
+}
+
+// matchFilter проверяет соответствие топика фильтру mqtt с символами '+' и '#'.
+func matchFilter(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// containsString проверяет наличие строки в срезе.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Типы колонок для логических значений.
+const (
+	boolTypeUInt8 = "UInt8"
+	boolTypeBool  = "Bool"
+)
+
+// nullBaseType тип колонки для значения null, если для колонки не задан тип.
+const nullBaseType = "String"
+
+// TypeSettings описывает определение типов колонок по значениям сообщения.
+// Bool - тип колонки для логических значений (UInt8 или Bool),
+// Columns - типы ClickHouse для отдельных колонок, заменяют определенные по значению.
+type TypeSettings struct {
+	Bool    string            `json:"bool"`
+	Columns map[string]string `json:"columns"`
+}
+
+// validate проверяет корректность настроек типов колонок.
+func (t TypeSettings) validate() error {
+	switch t.Bool {
+	case boolTypeUInt8, boolTypeBool:
+	default:
+		return fmt.Errorf("Тип колонки для логических значений должен быть %s или %s, указано '%s'\n",
+			boolTypeUInt8, boolTypeBool, t.Bool)
+	}
+
+	for name, colType := range t.Columns {
+		if strings.TrimSpace(colType) == "" {
+			return fmt.Errorf("Для колонки %s указан пустой тип\n", name)
+		}
+	}
+	return nil
+}
+
+// normalizeValue преобразовывает значение из сообщения для записи в колонку name.
+// Целые числа становятся int64, остальные числа float64, строки RFC3339 - временем,
+// если для колонки не задан другой тип. Массивы с элементами разных типов записываются строкой JSON.
+func (t TypeSettings) normalizeValue(name string, value interface{}) interface{} {
+	colType, ok := t.Columns[name]
+
+	switch v := value.(type) {
+	case json.Number:
+		return numberValue(v, ok && isFloatType(colType))
+	case string:
+		if ok && !strings.HasPrefix(unwrapNullable(colType), "DateTime") {
+			return v
+		}
+		if timestamp, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return timestamp.UTC()
+		}
+	case []interface{}:
+		values := normalizeArray(v)
+		if _, err := t.arrayItemType(values); err != nil {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Sprint(v)
+			}
+			return string(raw)
+		}
+		return values
+	}
+	return value
+}
+
+// normalizeArray преобразовывает числа во вложенных массивах в int64 или float64.
+func normalizeArray(values []interface{}) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case json.Number:
+			value = numberValue(v, false)
+		case []interface{}:
+			value = normalizeArray(v)
+		}
+		result[i] = value
+	}
+	return result
+}
+
+// columnType возвращает тип колонки name для значения value.
+func (t TypeSettings) columnType(name string, value interface{}) (string, error) {
+	colType, ok := t.Columns[name]
+	if ok {
+		if value == nil && !strings.HasPrefix(colType, "Nullable(") {
+			return fmt.Sprintf("Nullable(%s)", colType), nil
+		}
+		return colType, nil
+	}
+
+	if value == nil {
+		return fmt.Sprintf("Nullable(%s)", nullBaseType), nil
+	}
+	return t.valueType(value)
+}
+
+// valueType определяет тип ClickHouse по значению.
+func (t TypeSettings) valueType(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case int, int64:
+		return "Int64", nil
+	case uint64:
+		return "UInt64", nil
+	case float64:
+		return "Float64", nil
+	case string:
+		return "String", nil
+	case bool:
+		return t.Bool, nil
+	case time.Time:
+		return settings.Timestamp.columnType(), nil
+	case []interface{}:
+		itemType, err := t.arrayItemType(v)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Array(%s)", itemType), nil
+	}
+
+	return "", fmt.Errorf("Значение %v имеет некорректный формат.\n", value)
+}
+
+// arrayItemType определяет общий тип элементов массива.
+// Целые и дробные числа приводятся к Float64, null делает тип элементов Nullable.
+func (t TypeSettings) arrayItemType(values []interface{}) (string, error) {
+	var itemType string
+	var nullable bool
+
+	for _, value := range values {
+		if value == nil {
+			nullable = true
+			continue
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			return "", fmt.Errorf("Массив содержит объекты\n")
+		}
+
+		valueType, err := t.valueType(value)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case itemType == "" || itemType == valueType:
+			itemType = valueType
+		case isNumberType(itemType) && isNumberType(valueType):
+			itemType = "Float64"
+		default:
+			return "", fmt.Errorf("Массив содержит значения разных типов: %s и %s\n", itemType, valueType)
+		}
+	}
+
+	if itemType == "" {
+		itemType = nullBaseType
+	}
+	if nullable {
+		if strings.HasPrefix(itemType, "Array(") {
+			return "", fmt.Errorf("Вложенные массивы не могут содержать null\n")
+		}
+		itemType = fmt.Sprintf("Nullable(%s)", itemType)
+	}
+	return itemType, nil
+}
+
+// numberValue преобразовывает число из сообщения в int64, если оно целое, иначе в float64.
+func numberValue(number json.Number, asFloat bool) interface{} {
+	if !asFloat {
+		if i, err := number.Int64(); err == nil {
+			return i
+		}
+	}
+
+	f, err := number.Float64()
+	if err != nil {
+		return number.String()
+	}
+	return f
+}
+
+// isNumberType проверяет, что тип является числовым типом, определяемым по значению.
+func isNumberType(colType string) bool {
+	return colType == "Int64" || colType == "Float64"
+}
+
+// isFloatType проверяет, что тип колонки является дробным числом.
+func isFloatType(colType string) bool {
+	colType = unwrapNullable(colType)
+	return strings.HasPrefix(colType, "Float") || strings.HasPrefix(colType, "Decimal")
+}
+
+// unwrapNullable возвращает тип без обертки Nullable.
+func unwrapNullable(colType string) string {
+	if strings.HasPrefix(colType, "Nullable(") && strings.HasSuffix(colType, ")") {
+		return colType[len("Nullable(") : len(colType)-1]
+	}
+	return colType
+}
+
+// decodeJSON разбирает сообщение JSON с сохранением точности чисел.
+func decodeJSON(message []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("Сообщение содержит данные после значения JSON\n")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestColumnTypes(t *testing.T) {
+	message := `{"int":9007199254740993,"float":27.8,"text":"ok","flag":true,"empty":null,` +
+		`"list":[1,2.5],"tags":["a",null],"mixed":[1,"a"],"seen":"2021-11-24T20:27:23Z","code":42,"level":null}`
+
+	s := DefaultSettings()
+	s.Types.Columns = map[string]string{"code": "UInt16", "level": "Float32", "seen": "String"}
+	if err := Configure(s); err != nil {
+		t.Fatalf("Ошибка применения настроек: %s", err)
+	}
+	defer func() { _ = Configure(DefaultSettings()) }()
+
+	topicData := DataRecord{"tableName": "temp_out", "fields": []Pair{}}
+	received := time.Date(2021, 11, 25, 10, 0, 0, 0, time.UTC)
+	records, err := topicData.getDataFromMessage("", []byte(message), received, TopicSettings{})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Ошибка при получении полей из сообщения: %s", err)
+	}
+	recordData := records[0]
+
+	expectedTypes := []ColumnsType{
+		{"code", "UInt16"},
+		{"empty", "Nullable(String)"},
+		{"flag", "UInt8"},
+		{"float", "Float64"},
+		{"int", "Int64"},
+		{"level", "Nullable(Float32)"},
+		{"list", "Array(Float64)"},
+		{"mixed", "String"},
+		{"seen", "String"},
+		{"tags", "Array(Nullable(String))"},
+		{"text", "String"},
+		{"timestamp", "DateTime64(3)"},
+	}
+	if !reflect.DeepEqual(recordData["fieldsType"], expectedTypes) {
+		t.Errorf("Типы колонок. Ожидание: %v, факт: %v", expectedTypes, recordData["fieldsType"])
+	}
+
+	expectedValues := map[string]interface{}{
+		"int":   int64(9007199254740993),
+		"code":  int64(42),
+		"mixed": `[1,"a"]`,
+		"seen":  "2021-11-24T20:27:23Z",
+		"list":  []interface{}{int64(1), 2.5},
+	}
+	for _, field := range recordData["fields"].([]Pair) {
+		expected, ok := expectedValues[field.Name]
+		if ok && !reflect.DeepEqual(field.Value, expected) {
+			t.Errorf("Значение поля %s. Ожидание: %v (%T), факт: %v (%T)",
+				field.Name, expected, expected, field.Value, field.Value)
+		}
+	}
+}
+
+func TestValueType(t *testing.T) {
+	types := TypeSettings{Bool: boolTypeBool}
+	timestamp := time.Date(2021, 11, 24, 20, 27, 23, 0, time.UTC)
+
+	type testVariant struct {
+		value   interface{}
+		colType string
+		isErr   bool
+	}
+
+	testVariants := []*testVariant{
+		{value: int64(1), colType: "Int64"},
+		{value: 1.5, colType: "Float64"},
+		{value: true, colType: "Bool"},
+		{value: timestamp, colType: "DateTime64(3)"},
+		{value: types.normalizeValue("seen", "2021-11-24T20:27:23Z"), colType: "DateTime64(3)"},
+		{value: []interface{}{}, colType: "Array(String)"},
+		{value: []interface{}{[]interface{}{int64(1)}, []interface{}{int64(2)}}, colType: "Array(Array(Int64))"},
+		{value: []interface{}{true, false}, colType: "Array(Bool)"},
+		{value: []interface{}{true, "a"}, isErr: true},
+		{value: []interface{}{map[string]interface{}{}}, isErr: true},
+		{value: struct{}{}, isErr: true},
+	}
+
+	for i, v := range testVariants {
+		colType, err := types.valueType(v.value)
+		if (err != nil) != v.isErr {
+			t.Errorf("№%v. Возникновение ошибки. Ожидание: %v, факт: %v", i, v.isErr, err)
+		}
+		if colType != v.colType {
+			t.Errorf("№%v. Тип колонки. Ожидание: %s, факт: %s", i, v.colType, colType)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package metrics описывает метрики работы приложения в формате Prometheus.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mqtt2clickhouse/message"
+	"net/http"
+)
+
+const namespace = "mqtt2clickhouse"
+
+var (
+	// MessagesReceived количество сообщений, полученных из mqtt, по подпискам.
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from the MQTT broker by subscription filter.",
+	}, []string{"filter"})
+
+	// RecordsWritten количество строк, записанных в БД, по таблицам.
+	RecordsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_written_total",
+		Help:      "Rows inserted into ClickHouse.",
+	}, []string{"table"})
+
+	// ParseFailures количество сообщений, которые не удалось преобразовать, по причинам.
+	ParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Messages that could not be converted.",
+	}, []string{"reason"})
+
+	// WriteFailures количество сообщений, которые не удалось записать в БД, по причинам.
+	WriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_failures_total",
+		Help:      "Messages that could not be written to ClickHouse.",
+	}, []string{"reason"})
+
+	// Coercions количество значений, приведенных к типу колонки таблицы.
+	Coercions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coercions_total",
+		Help:      "Values converted to the type of an existing column.",
+	}, []string{"table", "from", "to"})
+
+	// CoercionFailures количество значений, которые не удалось привести к типу колонки таблицы.
+	CoercionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coercion_failures_total",
+		Help:      "Values that could not be converted to the type of an existing column.",
+	}, []string{"table", "from", "to"})
+
+	// InsertDuration длительность запросов INSERT по таблицам.
+	InsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_insert_duration_seconds",
+		Help:      "Duration of INSERT queries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"table"})
+
+	// QueueDepth количество сообщений в очереди на запись.
+	QueueDepth = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Messages waiting in the data channel.",
+	}, func() float64 {
+		return float64(len(message.DataChannel))
+	})
+
+	// MQTTConnected состояние подключения к mqtt: 1 - подключено, 0 - нет.
+	MQTTConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "MQTT connection state.",
+	})
+
+	// MQTTReconnects количество попыток переподключения к mqtt.
+	MQTTReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_reconnects_total",
+		Help:      "MQTT reconnect attempts.",
+	})
+
+	// ConsulReloads количество обновлений списка топиков из consul.
+	ConsulReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "consul_topic_reloads_total",
+		Help:      "Topic list reloads from Consul.",
+	})
+)
+
+// Handler возвращает обработчик http запросов для получения метрик.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}